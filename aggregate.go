@@ -0,0 +1,183 @@
+package snapsdb
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// the aggregates of a numeric field over the objects of a bucket
+type Aggregate struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// the average of the values, 0 without values
+func (a *Aggregate) Avg() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+	return a.Sum / float64(a.Count)
+}
+
+func (a *Aggregate) add(value float64) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	a.Count++
+	a.Sum += value
+}
+
+// the aggregates of one bucket of an aggregation query
+type AggregateBucket struct {
+	Begin time.Time // begin time of the bucket
+	// aggregates by the value of the group-by field, the only key is "" without WithGroupBy
+	Groups map[string]*Aggregate
+}
+
+/* Aggregate the objects of every bucket by the value of the field, e.g. "name", enum fields are grouped by the value name. only used by Aggregate. default("", one group) */
+func WithGroupBy(field string) QueryOption {
+	return func(o *queryOptions) {
+		o.groupBy = field
+	}
+}
+
+// aggregate the numeric field of the objects between begin and end into buckets of the bucket duration,
+// the buckets start at begin and only buckets with objects are returned, in time order.
+// the objects are decoded one by one into message and never collected, filters of opts are applied before the aggregation
+// the raw data is read whatever the range width, WithResolution aggregates the objects of a rollup tier instead
+/*
+	@example
+	buckets, err := db.Aggregate(begin, end, time.Minute, &types.ProcessInfo{}, "cpu", snapsdb.WithGroupBy("name"))
+	for _, bucket := range buckets {
+		fmt.Println(bucket.Begin, bucket.Groups["nginx"].Avg(), bucket.Groups["nginx"].Max)
+	}
+*/
+func (db *defaultDB) Aggregate(begin time.Time, end time.Time, bucket time.Duration, message StoreData, field string, opts ...QueryOption) ([]*AggregateBucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("invalid bucket size %v", bucket)
+	}
+	options := newQueryOptions(opts)
+	reflectMessage := message.ProtoReflect()
+	descriptor := reflectMessage.Descriptor()
+	path, err := resolveFieldPath(descriptor, field)
+	if err != nil {
+		return nil, err
+	}
+	if !isNumericKind(path[len(path)-1].Kind()) {
+		return nil, fmt.Errorf("field %s of kind %s can not be aggregated", field, path[len(path)-1].Kind())
+	}
+	var groupPath []protoreflect.FieldDescriptor
+	if options.groupBy != "" {
+		if groupPath, err = resolveFieldPath(descriptor, options.groupBy); err != nil {
+			return nil, err
+		}
+		if kind := groupPath[len(groupPath)-1].Kind(); kind == protoreflect.MessageKind || kind == protoreflect.GroupKind {
+			return nil, fmt.Errorf("message field %s can not be grouped by", options.groupBy)
+		}
+	}
+	filter, err := options.filter(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	// the raw data is aggregated unless a rollup tier is asked for, aggregates of reduced values are not the same
+	source := db
+	if options.resolution > 0 {
+		source, err = db.source(begin, end, options.resolution)
+	}
+	if err == nil {
+		err = source.checkSchema(begin, end, descriptor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*AggregateBucket, 0)
+	var current *AggregateBucket
+	err = source.walkRange(begin, end, false, func(timeline time.Time) bool {
+		start := begin
+		if offset := timeline.Sub(begin); offset > 0 {
+			start = begin.Add(offset / bucket * bucket)
+		}
+		if current == nil || !current.Begin.Equal(start) {
+			// a bucket whose objects were all filtered is dropped
+			if current != nil && len(current.Groups) == 0 {
+				buckets = buckets[:len(buckets)-1]
+			}
+			current = &AggregateBucket{Begin: start, Groups: make(map[string]*Aggregate)}
+			buckets = append(buckets, current)
+		}
+		return true
+	}, func(data []byte) error {
+		if err := source.options.codec.Unmarshal(data, message); err != nil {
+			return err
+		}
+		if filter != nil && !filter(message) {
+			return nil
+		}
+		value := numericValue(path[len(path)-1], fieldValueOf(reflectMessage, path))
+		if math.IsNaN(value) {
+			return nil
+		}
+		key := ""
+		if groupPath != nil {
+			key = groupKey(groupPath[len(groupPath)-1], fieldValueOf(reflectMessage, groupPath))
+		}
+		aggregate := current.Groups[key]
+		if aggregate == nil {
+			aggregate = &Aggregate{}
+			current.Groups[key] = aggregate
+		}
+		aggregate.add(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && len(current.Groups) == 0 {
+		buckets = buckets[:len(buckets)-1]
+	}
+	return buckets, nil
+}
+
+func (db *defaultDB) AggregateUnix(begin int64, end int64, bucket time.Duration, message StoreData, field string, opts ...QueryOption) ([]*AggregateBucket, error) {
+	return db.Aggregate(time.Unix(begin, 0), time.Unix(end, 0), bucket, message, field, opts...)
+}
+
+func isNumericKind(kind protoreflect.Kind) bool {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind,
+		protoreflect.FloatKind, protoreflect.DoubleKind:
+		return true
+	}
+	return false
+}
+
+// the value of a numeric field as float64
+func numericValue(fd protoreflect.FieldDescriptor, value protoreflect.Value) float64 {
+	switch fd.Kind() {
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(value.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return value.Float()
+	}
+	return float64(value.Int())
+}
+
+// the group of a field value, enum values are grouped by name
+func groupKey(fd protoreflect.FieldDescriptor, value protoreflect.Value) string {
+	if fd.Kind() == protoreflect.EnumKind {
+		if enumValue := fd.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return string(enumValue.Name())
+		}
+	}
+	return fmt.Sprint(value.Interface())
+}
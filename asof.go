@@ -0,0 +1,132 @@
+package snapsdb
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// query the latest timeline with data at or before timeline into the slice, the index tables are walked backwards
+// across the days up to lookback before timeline (0 walks back to the first storage file).
+// with filters the latest timeline with matching objects is returned, the timelines without are skipped.
+// returns the begin time of the timeline found, the zero time when there is none
+/*
+	@example
+	list := make([]types.ProcessInfo, 0)
+	found, err := db.QueryAsOf(time.Now(), time.Minute, &list)
+	if err == nil && !found.IsZero() {
+		fmt.Println("snapshot of", found, len(list))
+	}
+*/
+func (db *defaultDB) QueryAsOf(timeline time.Time, lookback time.Duration, out_list interface{}, opts ...QueryOption) (time.Time, error) {
+	options := newQueryOptions(opts)
+	source, err := db.source(timeline, timeline, options.resolution)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var earliest time.Time
+	if lookback > 0 {
+		earliest = timeline.Add(-lookback)
+	}
+	// the storage files are listed once, a search back after a filter miss reuses them
+	baselines, err := source.storageBaselines()
+	if err != nil {
+		return time.Time{}, err
+	}
+	list := reflect.Indirect(reflect.ValueOf(out_list))
+	filtered := len(options.filters) > 0 || len(options.expressions) > 0
+	for {
+		found, ok, err := source.latestTimeline(baselines, timeline, earliest)
+		if err != nil || !ok {
+			return time.Time{}, err
+		}
+		length := 0
+		if list.Kind() == reflect.Slice {
+			length = list.Len()
+		}
+		err = source.QueryTimeline(found, out_list, opts...)
+		if err != nil || !filtered || list.Len() > length {
+			return found, err
+		}
+		// no object of the timeline matches the filters, the timelines before it are searched
+		timeline = found.Add(-source.options.resolution)
+	}
+}
+
+func (db *defaultDB) QueryAsOfUnix(timeline int64, lookback time.Duration, out_list interface{}, opts ...QueryOption) (time.Time, error) {
+	return db.QueryAsOf(time.Unix(timeline, 0), lookback, out_list, opts...)
+}
+
+// query the latest timeline with data at or before timeline, up to lookback before it (0 for no limit).
+// returns nil when there is none
+/*
+	@example
+	latest, err := snapsdb.QueryAsOf[types.ProcessInfo](db, time.Now(), 0)
+*/
+func QueryAsOf[T any, PT interface {
+	*T
+	proto.Message
+}](db SnapsDB, timeline time.Time, lookback time.Duration, opts ...QueryOption) (*TimelineData[T], error) {
+	list := make([]T, 0)
+	found, err := db.QueryAsOf(timeline, lookback, &list, opts...)
+	if err != nil || found.IsZero() {
+		return nil, err
+	}
+	return &TimelineData[T]{Timeline: found, Data: list}, nil
+}
+
+// the begin time of the latest timeline with records between earliest and timeline in the storage files of baselines,
+// ok is false when there is none. the zero earliest searches back to the first storage file
+func (db *defaultDB) latestTimeline(baselines []int64, timeline time.Time, earliest time.Time) (time.Time, bool, error) {
+	if earliest.IsZero() && len(baselines) > 0 {
+		earliest = time.Unix(baselines[0], 0)
+	}
+	last := util.GetUnixOfDay(timeline)
+	// the storage files of the days before timeline, the latest first
+	for i := sort.Search(len(baselines), func(i int) bool { return baselines[i] > last }) - 1; i >= 0; i-- {
+		if time.Unix(baselines[i], 0).Add(TimestampOf1Day).Before(earliest) {
+			break
+		}
+		file, err := db.loadFile(baselines[i], false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		found, ok, err := file.(*storeFile).latestTimeline(earliest, timeline)
+		if err != nil || ok {
+			return found, ok, err
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// the begin time of the latest timeline with records between begin and end
+func (sf *storeFile) latestTimeline(begin time.Time, end time.Time) (time.Time, bool, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return time.Time{}, false, ErrorFileClosed
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var found time.Time
+	hit := false
+	// the table is read backwards in chunks up to the first timeline with records
+	err := sf.walkIndexTable(beginIndex, endIndex, true, func(index int64, meta *timelineMateInfo) bool {
+		if meta.TLFirst != 0 {
+			found, hit = sf.timelineOf(index), true
+		}
+		return !hit
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return found, hit, nil
+}
@@ -0,0 +1,72 @@
+// snapsdb-fsck checks snapsdb storage files and optionally repairs them.
+//
+//	snapsdb-fsck [-repair] <data directory | storage file>...
+//
+// the files must not be opened by a running database.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/util"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "rebuild the index table of damaged files from the data block")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-repair] <data directory | storage file>...\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	files := make([]string, 0)
+	for _, arg := range flag.Args() {
+		stat, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, util.Red(err.Error()))
+			os.Exit(2)
+		}
+		if !stat.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(arg, "*.bin"))
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	damaged := 0
+	for _, file := range files {
+		report, err := snapsdb.VerifyFile(file, *repair)
+		if err != nil {
+			fmt.Printf("%s %s\n", file, util.Red(err.Error()))
+			damaged++
+			continue
+		}
+		if report.OK() {
+			fmt.Printf("%s %s, %d records\n", file, util.Green("ok"), report.Records)
+			continue
+		}
+		for _, issue := range report.Issues {
+			fmt.Printf("%s %s\n", file, util.Yellow(issue.String()))
+		}
+		for _, skipped := range report.Skipped {
+			fmt.Printf("%s %s\n", file, util.Yellow(fmt.Sprintf("skipped %d damaged bytes @%d", skipped.Length, skipped.Address)))
+		}
+		if report.Repaired {
+			fmt.Printf("%s %s\n", file, util.Green("index table rebuilt"))
+		} else {
+			damaged++
+		}
+	}
+	if damaged > 0 {
+		os.Exit(1)
+	}
+}
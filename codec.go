@@ -0,0 +1,164 @@
+package snapsdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// encodes the objects of the database into the records of the storage files, see WithCodec.
+// the id is stored in the header of every storage file, ids below 256 are reserved for the built-in codecs
+type Codec interface {
+	// the codec id stored in the file header
+	ID() uint32
+	Marshal(value interface{}) ([]byte, error)
+	// decode data into the value pointer, fields missing from data are reset
+	Unmarshal(data []byte, value interface{}) error
+}
+
+/* built-in codec ids */
+const (
+	// protobuf wire format, files written before codecs were stored use it
+	CodecProtobuf = uint32(0)
+	// encoding/json, protobuf messages are encoded by protojson
+	CodecJSON = uint32(1)
+	// encoding/gob, every object carries its type information
+	CodecGob = uint32(2)
+	// the bytes of Binary or []byte as they are
+	CodecBinary = uint32(3)
+)
+
+var (
+	// the default codec, objects are protobuf messages
+	ProtobufCodec Codec = protobufCodec{}
+	// objects are any values encoding/json handles
+	JSONCodec Codec = jsonCodec{}
+	// objects are any values encoding/gob handles
+	GobCodec Codec = gobCodec{}
+	// objects are Binary or []byte, queried into Binary or []byte elements
+	BinaryCodec Codec = binaryCodec{}
+)
+
+type protobufCodec struct{}
+
+func (protobufCodec) ID() uint32 {
+	return CodecProtobuf
+}
+
+func (protobufCodec) Marshal(value interface{}) ([]byte, error) {
+	message, ok := value.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Marshal(message)
+}
+
+func (protobufCodec) Unmarshal(data []byte, value interface{}) error {
+	message, ok := value.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint32 {
+	return CodecJSON
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	if message, ok := value.(proto.Message); ok {
+		return protojson.Marshal(message)
+	}
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	if message, ok := value.(proto.Message); ok {
+		return protojson.Unmarshal(data, message)
+	}
+	if err := resetValue(value); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() uint32 {
+	return CodecGob
+}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := gob.NewEncoder(buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, value interface{}) error {
+	// gob leaves the zero fields out
+	if err := resetValue(value); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) ID() uint32 {
+	return CodecBinary
+}
+
+func (binaryCodec) Marshal(value interface{}) ([]byte, error) {
+	switch data := value.(type) {
+	case Binary:
+		return data, nil
+	case []byte:
+		return data, nil
+	case *Binary:
+		return *data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return nil, fmt.Errorf("%T is not binary data", value)
+}
+
+func (binaryCodec) Unmarshal(data []byte, value interface{}) error {
+	switch target := value.(type) {
+	case *Binary:
+		*target = append(Binary{}, data...)
+	case *[]byte:
+		*target = append([]byte{}, data...)
+	default:
+		return fmt.Errorf("%T is not a pointer to binary data", value)
+	}
+	return nil
+}
+
+// set the value the pointer points to to its zero value
+func resetValue(value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("%T is not a pointer", value)
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	return nil
+}
+
+// the built-in codec of the id, nil for other ids
+func builtinCodec(id uint32) Codec {
+	for _, codec := range []Codec{ProtobufCodec, JSONCodec, GobCodec, BinaryCodec} {
+		if codec.ID() == id {
+			return codec
+		}
+	}
+	return nil
+}
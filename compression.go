@@ -0,0 +1,111 @@
+package snapsdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compression of the records in a storage file
+type Compression uint32
+
+const (
+	// every object is stored in its own record
+	CompressionNone Compression = iota
+	// the objects of one write are stored in one deflate compressed record
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(c))
+}
+
+func checkCompression(c Compression) error {
+	if c != CompressionNone && c != CompressionFlate {
+		return fmt.Errorf("unsupported compression %s", c)
+	}
+	return nil
+}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return writer
+}}
+
+var flateReaders = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// compress the data of one record
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+		writer := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(writer)
+		writer.Reset(buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+// decompress the data of one record
+func (c Compression) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		reader := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(reader)
+		reader.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+		return io.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+// objects prefixed with their uvarint length
+func encodeBatch(items [][]byte) []byte {
+	size := 0
+	for _, item := range items {
+		size += binary.MaxVarintLen32 + len(item)
+	}
+	batch := make([]byte, 0, size)
+	length := make([]byte, binary.MaxVarintLen64)
+	for _, item := range items {
+		n := binary.PutUvarint(length, uint64(len(item)))
+		batch = append(batch, length[:n]...)
+		batch = append(batch, item...)
+	}
+	return batch
+}
+
+func decodeBatch(batch []byte, fn func(item []byte) error) error {
+	for len(batch) > 0 {
+		length, n := binary.Uvarint(batch)
+		if n <= 0 || uint64(len(batch)-n) < length {
+			return io.ErrUnexpectedEOF
+		}
+		if err := fn(batch[n : n+int(length)]); err != nil {
+			return err
+		}
+		batch = batch[n+int(length):]
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package snapsdb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+)
+
+// the timelines with data in a time range, read from the index tables without decoding any record
+type Coverage struct {
+	Begin      time.Time     // begin time of the first timeline of the range
+	Resolution time.Duration // duration of one timeline
+	Length     int           // number of timelines in the range
+	Bitmap     []uint64      // bit i is set when timeline i has data
+	Counts     []uint32      // records of every timeline, nil unless requested. a compressed or delta record holds one write
+}
+
+// a range of timelines with data, End is the end of the last timeline
+type Interval struct {
+	Begin time.Time
+	End   time.Time
+}
+
+// the timeline of t has data
+func (c *Coverage) Has(t time.Time) bool {
+	i, ok := c.indexOf(t)
+	return ok && c.has(i)
+}
+
+func (c *Coverage) has(i int) bool {
+	return c.Bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+func (c *Coverage) indexOf(t time.Time) (int, bool) {
+	if t.Before(c.Begin) {
+		return 0, false
+	}
+	i := int(t.Sub(c.Begin) / c.Resolution)
+	return i, i < c.Length
+}
+
+// the ranges of consecutive timelines with data in time order
+func (c *Coverage) Intervals() []Interval {
+	intervals := make([]Interval, 0)
+	for i := 0; i < c.Length; i++ {
+		if !c.has(i) {
+			continue
+		}
+		begin := i
+		for i+1 < c.Length && c.has(i+1) {
+			i++
+		}
+		intervals = append(intervals, Interval{Begin: c.timelineOf(begin), End: c.timelineOf(i + 1)})
+	}
+	return intervals
+}
+
+// the begin time of the timeline with data nearest to t, the earlier one on a tie. ok is false without data
+func (c *Coverage) Nearest(t time.Time) (time.Time, bool) {
+	i, _ := c.indexOf(t)
+	if t.Before(c.Begin) {
+		i = 0
+	} else if i >= c.Length {
+		i = c.Length - 1
+	}
+	for distance := 0; distance < c.Length; distance++ {
+		if i-distance >= 0 && c.has(i-distance) {
+			return c.timelineOf(i - distance), true
+		}
+		if i+distance < c.Length && c.has(i+distance) {
+			return c.timelineOf(i + distance), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (c *Coverage) timelineOf(i int) time.Time {
+	return c.Begin.Add(time.Duration(i) * c.Resolution)
+}
+
+// the timelines with data between begin and end at the database resolution, with counts the records
+// of every timeline are counted by following the record headers
+/*
+	@example
+	coverage, err := db.Coverage(begin, end, false)
+	for _, interval := range coverage.Intervals() {
+		fmt.Println(interval.Begin, interval.End)
+	}
+*/
+func (db *defaultDB) Coverage(begin time.Time, end time.Time, counts bool) (*Coverage, error) {
+	if end.Before(begin) {
+		return nil, errors.New("is not a valid time range")
+	}
+	resolution := db.options.resolution
+	coverage := &Coverage{Begin: alignTimeline(begin, resolution), Resolution: resolution}
+	coverage.Length = int(end.Sub(coverage.Begin)/resolution) + 1
+	coverage.Bitmap = make([]uint64, (coverage.Length+63)/64)
+	if counts {
+		coverage.Counts = make([]uint32, coverage.Length)
+	}
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = file.(*storeFile).coverage(begin, end, counts, func(timeline time.Time, records uint32) {
+			// a timeline of a file with another resolution sets the timeline it begins in
+			if i, ok := coverage.indexOf(timeline); ok {
+				coverage.Bitmap[i/64] |= 1 << (i % 64)
+				if counts {
+					coverage.Counts[i] += records
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return coverage, nil
+}
+
+// call fn with every timeline with data between begin and end and its records when counted
+func (sf *storeFile) coverage(begin time.Time, end time.Time, counts bool, fn func(timeline time.Time, records uint32)) error {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return ErrorFileClosed
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return nil
+	}
+	var err error
+	// the table is streamed in chunks, it is not read at once
+	walkErr := sf.walkIndexTable(beginIndex, endIndex, false, func(index int64, meta *timelineMateInfo) bool {
+		if meta.TLFirst == 0 {
+			return true
+		}
+		records := uint32(0)
+		for next := meta.TLFirst; counts && next != 0; records++ {
+			var header *recordHeader
+			if header, err = sf.readRecordHeader(next); err != nil {
+				return false
+			}
+			if header.Timeline != sf.tickOf(index) {
+				break
+			}
+			next = header.Next
+		}
+		fn(sf.timelineOf(index), records)
+		return true
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
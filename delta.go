@@ -0,0 +1,407 @@
+package snapsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// delta frame format
+// =============================
+// files with FlagDelta store every write as one frame record, a frame is the full
+// snapshot of the write (keyframe) or the difference to the previous frame (delta).
+// the objects of a snapshot are matched between frames by their identity.
+//
+// frame kind     size 1 byte     0 keyframe, 1 delta
+// base address   size 8 byte     address of the previous frame, 0 for keyframes
+// entries        size ... byte   compressed with the file compression
+//
+// entry          op 1 byte | identity (uvarint length + bytes) | ...
+//   opFull       object (uvarint length + bytes)
+//   opKeep       the object of the base frame is unchanged
+//   opPatch      field count uvarint | field numbers uvarint ... | patch (uvarint length + bytes)
+//                the listed fields are removed from the object of the base frame and the patch is appended
+//
+// objects of the base frame that are not listed in a delta frame are deleted.
+// =============================
+
+const (
+	frameKeyframe = byte(0)
+	frameDelta    = byte(1)
+	frameHeadLen  = 1 + 8
+)
+
+const (
+	opFull  = byte(0)
+	opKeep  = byte(1)
+	opPatch = byte(2)
+)
+
+var errorFrameCorrupt = errors.New("delta frame is damaged")
+
+var deterministic = proto.MarshalOptions{Deterministic: true}
+
+// an object of a snapshot and its identity
+type deltaItem struct {
+	key  string
+	data []byte
+}
+
+// snapshot of a frame
+type deltaFrame struct {
+	address int64       // record address of the frame
+	items   []deltaItem // objects of the snapshot
+	frames  int         // deltas since the last keyframe
+}
+
+// encode the objects of one write into a frame record, the frame is a delta to the last written frame
+// unless there is none or the keyframe interval is reached
+func (sf *storeFile) encodeFrame(data []StoreData) ([]byte, *deltaFrame, error) {
+	frame := &deltaFrame{items: make([]deltaItem, 0, len(data))}
+	seen := make(map[string]int, len(data))
+	for i, item := range data {
+		outdata, err := deterministic.Marshal(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := sf.identityOf(item, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		// objects sharing an identity are told apart by their occurrence
+		if n := seen[key]; n > 0 {
+			seen[key] = n + 1
+			key = key + "\x00" + strconv.Itoa(n)
+		} else {
+			seen[key] = 1
+		}
+		frame.items = append(frame.items, deltaItem{key: key, data: outdata})
+	}
+	base := sf.lastFrame
+	kind := frameDelta
+	if base == nil || base.frames+1 >= sf.keyframes {
+		kind = frameKeyframe
+	} else {
+		frame.frames = base.frames + 1
+	}
+	body := make([]byte, 0, 256)
+	var baseItems map[string][]byte
+	if kind == frameDelta {
+		baseItems = make(map[string][]byte, len(base.items))
+		for _, item := range base.items {
+			baseItems[item.key] = item.data
+		}
+	}
+	for _, item := range frame.items {
+		previous, ok := baseItems[item.key]
+		if !ok {
+			body = appendEntry(body, opFull, item.key)
+			body = appendBytes(body, item.data)
+			continue
+		}
+		numbers, patch, err := diffWireFields(previous, item.data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(numbers) == 0 {
+			body = appendEntry(body, opKeep, item.key)
+		} else if len(patch)+len(numbers)*binary.MaxVarintLen32 >= len(item.data) {
+			body = appendEntry(body, opFull, item.key)
+			body = appendBytes(body, item.data)
+		} else {
+			body = appendEntry(body, opPatch, item.key)
+			body = appendUvarint(body, uint64(len(numbers)))
+			for _, number := range numbers {
+				body = appendUvarint(body, uint64(number))
+			}
+			body = appendBytes(body, patch)
+		}
+	}
+	body, err := sf.compression.compress(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, frameHeadLen, frameHeadLen+len(body))
+	payload[0] = kind
+	if kind == frameDelta {
+		binary.LittleEndian.PutUint64(payload[1:], uint64(base.address))
+	}
+	return append(payload, body...), frame, nil
+}
+
+// the keyframe record of a snapshot
+func (sf *storeFile) keyframe(items []deltaItem) ([]byte, error) {
+	body := make([]byte, 0, 256)
+	for _, item := range items {
+		body = appendEntry(body, opFull, item.key)
+		body = appendBytes(body, item.data)
+	}
+	body, err := sf.compression.compress(body)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, frameHeadLen, frameHeadLen+len(body))
+	payload[0] = frameKeyframe
+	return append(payload, body...), nil
+}
+
+// identity of an object, its position when no identity field is configured
+func (sf *storeFile) identityOf(item StoreData, position int) (string, error) {
+	if sf.identity == "" {
+		return strconv.Itoa(position), nil
+	}
+	message := item.ProtoReflect()
+	fields := message.Descriptor().Fields()
+	field := fields.ByName(sf.identity)
+	if field == nil {
+		field = fields.ByJSONName(string(sf.identity))
+	}
+	if field == nil {
+		return "", fmt.Errorf("identity field %s not found in %s", sf.identity, message.Descriptor().FullName())
+	}
+	return fmt.Sprint(message.Get(field).Interface()), nil
+}
+
+// the snapshot of the frame record, following the base frames back to the last keyframe
+func (sf *storeFile) frameItems(header *recordHeader, payload []byte) ([]deltaItem, error) {
+	cache := sf.cachedFrame()
+	if cache != nil && cache.address == header.Address {
+		return cache.items, nil
+	}
+	// frames from the requested one back to a keyframe or a cached frame
+	pending := make([][]byte, 0, 4)
+	var items []deltaItem
+	address := header.Address
+	for {
+		if len(payload) < frameHeadLen {
+			return nil, errorFrameCorrupt
+		}
+		if payload[0] == frameKeyframe {
+			items = []deltaItem{}
+			pending = append(pending, payload)
+			break
+		}
+		pending = append(pending, payload)
+		base := int64(binary.LittleEndian.Uint64(payload[1:frameHeadLen]))
+		// frames are appended, a base frame is always written before
+		if base >= address || base < sf.dataOffset() {
+			return nil, errorFrameCorrupt
+		}
+		if cache != nil && cache.address == base {
+			items = cache.items
+			break
+		}
+		baseHeader, err := sf.readRecordHeader(base)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = sf.readRecordData(baseHeader); err != nil {
+			return nil, err
+		}
+		address = base
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		var err error
+		if items, err = sf.applyFrame(items, pending[i]); err != nil {
+			return nil, err
+		}
+	}
+	sf.cacheFrame(&deltaFrame{address: header.Address, items: items})
+	return items, nil
+}
+
+// the last reconstructed frame, shared by concurrent queries, the items are never modified
+func (sf *storeFile) cachedFrame() *deltaFrame {
+	sf.cacheMutex.Lock()
+	defer sf.cacheMutex.Unlock()
+	return sf.frameCache
+}
+
+func (sf *storeFile) cacheFrame(frame *deltaFrame) {
+	sf.cacheMutex.Lock()
+	defer sf.cacheMutex.Unlock()
+	sf.frameCache = frame
+}
+
+// the objects of the snapshot of the frame record
+func (sf *storeFile) frameObjects(header *recordHeader, payload []byte) ([][]byte, error) {
+	items, err := sf.frameItems(header, payload)
+	if err != nil {
+		if _, ok := err.(*CorruptRecordError); !ok {
+			err = sf.corruptRecord(header, "delta frame: "+err.Error())
+		}
+		return nil, err
+	}
+	objects := make([][]byte, len(items))
+	for i, item := range items {
+		objects[i] = item.data
+	}
+	return objects, nil
+}
+
+// apply the entries of a frame to the snapshot of its base frame
+func (sf *storeFile) applyFrame(base []deltaItem, payload []byte) ([]deltaItem, error) {
+	body, err := sf.compression.decompress(payload[frameHeadLen:])
+	if err != nil {
+		return nil, err
+	}
+	baseItems := make(map[string][]byte, len(base))
+	for _, item := range base {
+		baseItems[item.key] = item.data
+	}
+	items := make([]deltaItem, 0, len(base))
+	reader := bytes.NewReader(body)
+	for reader.Len() > 0 {
+		op, _ := reader.ReadByte()
+		key, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		item := deltaItem{key: string(key)}
+		switch op {
+		case opFull:
+			if item.data, err = readBytes(reader); err != nil {
+				return nil, err
+			}
+		case opKeep:
+			previous, ok := baseItems[item.key]
+			if !ok {
+				return nil, errorFrameCorrupt
+			}
+			item.data = previous
+		case opPatch:
+			previous, ok := baseItems[item.key]
+			if !ok {
+				return nil, errorFrameCorrupt
+			}
+			count, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, errorFrameCorrupt
+			}
+			numbers := make(map[protowire.Number]bool, count)
+			for i := uint64(0); i < count; i++ {
+				number, err := binary.ReadUvarint(reader)
+				if err != nil {
+					return nil, errorFrameCorrupt
+				}
+				numbers[protowire.Number(number)] = true
+			}
+			patch, err := readBytes(reader)
+			if err != nil {
+				return nil, err
+			}
+			if item.data, err = applyWirePatch(previous, numbers, patch); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorFrameCorrupt
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// group the top level fields of a marshaled object by field number
+func splitWireFields(data []byte) (map[protowire.Number][]byte, error) {
+	fields := make(map[protowire.Number][]byte)
+	for len(data) > 0 {
+		number, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(number, kind, data[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		fields[number] = append(fields[number], data[:n+m]...)
+		data = data[n+m:]
+	}
+	return fields, nil
+}
+
+// the numbers of the fields that differ and the new values of the changed fields
+func diffWireFields(previous []byte, current []byte) ([]protowire.Number, []byte, error) {
+	if bytes.Equal(previous, current) {
+		return nil, nil, nil
+	}
+	before, err := splitWireFields(previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := splitWireFields(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	numbers := make([]protowire.Number, 0)
+	for number, value := range after {
+		if !bytes.Equal(before[number], value) {
+			numbers = append(numbers, number)
+		}
+	}
+	for number := range before {
+		if _, ok := after[number]; !ok {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	patch := make([]byte, 0)
+	for _, number := range numbers {
+		patch = append(patch, after[number]...)
+	}
+	return numbers, patch, nil
+}
+
+// remove the listed fields from the marshaled object and append the patch
+func applyWirePatch(previous []byte, numbers map[protowire.Number]bool, patch []byte) ([]byte, error) {
+	data := make([]byte, 0, len(previous)+len(patch))
+	for len(previous) > 0 {
+		number, kind, n := protowire.ConsumeTag(previous)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(number, kind, previous[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if !numbers[number] {
+			data = append(data, previous[:n+m]...)
+		}
+		previous = previous[n+m:]
+	}
+	return append(data, patch...), nil
+}
+
+func appendEntry(body []byte, op byte, key string) []byte {
+	body = append(body, op)
+	return appendBytes(body, []byte(key))
+}
+
+func appendBytes(body []byte, data []byte) []byte {
+	body = appendUvarint(body, uint64(len(data)))
+	return append(body, data...)
+}
+
+func appendUvarint(body []byte, value uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buffer, value)
+	return append(body, buffer[:n]...)
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return nil, errorFrameCorrupt
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return nil, errorFrameCorrupt
+	}
+	return data, nil
+}
@@ -0,0 +1,312 @@
+package snapsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// field expression
+// =============================
+// a field expression compares fields of the message with literals, e.g.
+//
+//	pid == 1234
+//	name startswith "java" && cpu > 80
+//	state == RUNNING || memory.rss >= 1e9
+//
+// field     field name or json name, nested message fields are separated by dots
+// operator  == != < <= > >= startswith contains
+// literal   number, "string" or 'string', true, false, or the name of an enum value
+//
+// && binds tighter than ||, parentheses are not supported.
+// repeated, map and bytes fields can not be compared.
+// =============================
+
+// a compiled field expression, the conditions of every group must match and any group matches
+type fieldExpression [][]*fieldCondition
+
+type fieldCondition struct {
+	path     []protoreflect.FieldDescriptor // fields from the message to the compared field
+	operator string
+	text     string  // literal as written, unquoted
+	integer  int64   // literal as int64 when intOK
+	unsigned uint64  // literal as uint64 when uintOK
+	float    float64 // literal as float64 when number
+	intOK    bool
+	uintOK   bool
+	number   bool
+	boolean  bool
+}
+
+// compile the expression against the fields of the message descriptor
+func compileFieldExpression(expression string, descriptor protoreflect.MessageDescriptor) (fieldExpression, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	compiled := make(fieldExpression, 0)
+	group := make([]*fieldCondition, 0)
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete condition at '%s' in field expression %q", strings.Join(tokens, " "), expression)
+		}
+		condition, err := compileCondition(tokens[0], tokens[1], tokens[2], descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("%v in field expression %q", err, expression)
+		}
+		group = append(group, condition)
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			break
+		}
+		switch tokens[0] {
+		case "||":
+			compiled = append(compiled, group)
+			group = make([]*fieldCondition, 0)
+		case "&&":
+		default:
+			return nil, fmt.Errorf("expected && or || at '%s' in field expression %q", tokens[0], expression)
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("field expression %q ends with an operator", expression)
+		}
+	}
+	if len(group) == 0 {
+		return nil, fmt.Errorf("empty field expression")
+	}
+	return append(compiled, group), nil
+}
+
+func compileCondition(field string, operator string, literal string, descriptor protoreflect.MessageDescriptor) (*fieldCondition, error) {
+	condition := &fieldCondition{operator: operator}
+	switch operator {
+	case "==", "!=", "<", "<=", ">", ">=", "startswith", "contains":
+	default:
+		return nil, fmt.Errorf("unknown operator %s", operator)
+	}
+	path, err := resolveFieldPath(descriptor, field)
+	if err != nil {
+		return nil, err
+	}
+	condition.path = path
+	fd := path[len(path)-1]
+	if text, err := strconv.Unquote(literal); err == nil {
+		condition.text = text
+	} else if literal[0] == '\'' && len(literal) > 1 && literal[len(literal)-1] == '\'' {
+		condition.text = literal[1 : len(literal)-1]
+	} else {
+		condition.text = literal
+		condition.integer, err = strconv.ParseInt(literal, 0, 64)
+		condition.intOK = err == nil
+		condition.unsigned, err = strconv.ParseUint(literal, 0, 64)
+		condition.uintOK = err == nil
+		if condition.intOK || condition.uintOK {
+			condition.float, condition.number = float64(condition.integer), true
+			if !condition.intOK {
+				condition.float = float64(condition.unsigned)
+			}
+		} else if condition.float, err = strconv.ParseFloat(literal, 64); err == nil {
+			condition.number = true
+		}
+	}
+	stringOperator := operator == "startswith" || operator == "contains"
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return condition, nil
+	case protoreflect.BoolKind:
+		if literal != "true" && literal != "false" || (operator != "==" && operator != "!=") {
+			return nil, fmt.Errorf("bool field %s can only be compared with == or != true/false", field)
+		}
+		condition.boolean = literal == "true"
+		return condition, nil
+	case protoreflect.EnumKind:
+		if !condition.intOK {
+			value := fd.Enum().Values().ByName(protoreflect.Name(condition.text))
+			if value == nil {
+				return nil, fmt.Errorf("%s is not a value of enum %s", condition.text, fd.Enum().FullName())
+			}
+			condition.integer, condition.intOK = int64(value.Number()), true
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind, protoreflect.BytesKind:
+		return nil, fmt.Errorf("field %s of kind %s can not be compared", field, fd.Kind())
+	default:
+		if !condition.number {
+			return nil, fmt.Errorf("field %s must be compared with a number, not %s", field, literal)
+		}
+	}
+	if stringOperator {
+		return nil, fmt.Errorf("%s can only be used on string fields", operator)
+	}
+	return condition, nil
+}
+
+// the fields from the message to the field of the dotted path, repeated fields are not allowed
+func resolveFieldPath(descriptor protoreflect.MessageDescriptor, field string) ([]protoreflect.FieldDescriptor, error) {
+	path := make([]protoreflect.FieldDescriptor, 0, 2)
+	message := descriptor
+	for _, name := range strings.Split(field, ".") {
+		if message == nil {
+			return nil, fmt.Errorf("field %s is not a message", field)
+		}
+		fd := message.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = message.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("field %s not found in %s", name, message.FullName())
+		}
+		if fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("repeated field %s can not be compared", name)
+		}
+		path = append(path, fd)
+		message = fd.Message()
+	}
+	return path, nil
+}
+
+// the value of the last field of the path, missing messages on the path yield the default value
+func fieldValueOf(message protoreflect.Message, path []protoreflect.FieldDescriptor) protoreflect.Value {
+	last := len(path) - 1
+	for _, fd := range path[:last] {
+		message = message.Get(fd).Message()
+	}
+	return message.Get(path[last])
+}
+
+// split the expression into fields, operators and literals
+func tokenizeExpression(expression string) ([]string, error) {
+	tokens := make([]string, 0)
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for ; end < len(runes) && runes[end] != r; end++ {
+				if runes[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in field expression %q", expression)
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		case strings.ContainsRune("=!<>&|", r):
+			end := i + 1
+			if end < len(runes) && strings.ContainsRune("=&|", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		default:
+			end := i
+			for ; end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("=!<>&|\"'", runes[end]); end++ {
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// the message matches the expression
+func (expression fieldExpression) match(message protoreflect.Message) bool {
+	for _, group := range expression {
+		matched := true
+		for _, condition := range group {
+			if !condition.match(message) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (condition *fieldCondition) match(message protoreflect.Message) bool {
+	fd := condition.path[len(condition.path)-1]
+	value := fieldValueOf(message, condition.path)
+	var compared int
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		text := value.String()
+		switch condition.operator {
+		case "startswith":
+			return strings.HasPrefix(text, condition.text)
+		case "contains":
+			return strings.Contains(text, condition.text)
+		}
+		compared = strings.Compare(text, condition.text)
+	case protoreflect.BoolKind:
+		return (value.Bool() == condition.boolean) == (condition.operator == "==")
+	case protoreflect.EnumKind:
+		compared = compareInt(int64(value.Enum()), condition.integer)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if condition.intOK {
+			compared = compareInt(value.Int(), condition.integer)
+		} else {
+			compared = compareFloat(float64(value.Int()), condition.float)
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if condition.uintOK {
+			compared = compareUint(value.Uint(), condition.unsigned)
+		} else {
+			compared = compareFloat(float64(value.Uint()), condition.float)
+		}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		compared = compareFloat(value.Float(), condition.float)
+	}
+	switch condition.operator {
+	case "==":
+		return compared == 0
+	case "!=":
+		return compared != 0
+	case "<":
+		return compared < 0
+	case "<=":
+		return compared <= 0
+	case ">":
+		return compared > 0
+	case ">=":
+		return compared >= 0
+	}
+	return false
+}
+
+func compareInt(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareUint(a uint64, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
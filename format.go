@@ -0,0 +1,307 @@
+package snapsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* file format versions */
+const (
+	// 16 byte header (LegacyMagicCode), one-second timelines, records without checksum
+	FormatVersion1 = uint32(1)
+	// 64 byte header (MagicCode) with resolution, feature flags and format version
+	FormatVersion2 = uint32(2)
+	// 64-bit record addresses in the index table and the record headers
+	FormatVersion3 = uint32(3)
+	// format version of new storage files
+	CurrentFormatVersion = FormatVersion3
+)
+
+// feature flags known by this version, files with other flags can not be read
+const knownFlags = FlagChecksum | FlagCompression | FlagDelta
+
+// 文件头
+type fileHeader struct {
+	Version     uint32        // file format version
+	Baseline    int64         // time base line of the file
+	Resolution  time.Duration // duration of one timeline
+	Flags       uint32        // feature flags
+	Compression Compression   // compression of the records, only with FlagCompression
+	Codec       uint32        // codec id of the objects, see Codec
+}
+
+// header of a new storage file
+func newFileHeader(timebaseline int64, resolution time.Duration, compression Compression, delta bool, codec uint32) *fileHeader {
+	header := &fileHeader{Version: CurrentFormatVersion, Baseline: timebaseline, Resolution: resolution, Flags: FlagChecksum, Codec: codec}
+	if compression != CompressionNone {
+		header.Flags |= FlagCompression
+		header.Compression = compression
+	}
+	if delta {
+		header.Flags |= FlagDelta
+	}
+	return header
+}
+
+// decode the file header, dispatching on the magic code and the format version
+func decodeFileHeader(buffer []byte) (*fileHeader, error) {
+	if len(buffer) < int(LegacyFileHeaderSize) {
+		return nil, ErrorInvalidStoreFile
+	}
+	header := &fileHeader{Baseline: int64(binary.LittleEndian.Uint64(buffer[8:16]))}
+	switch binary.LittleEndian.Uint64(buffer[:8]) {
+	case LegacyMagicCode:
+		header.Version = FormatVersion1
+		header.Resolution = time.Second
+		return header, nil
+	case MagicCode:
+		if len(buffer) < int(FileHeaderSize) {
+			return nil, ErrorInvalidStoreFile
+		}
+		header.Version = binary.LittleEndian.Uint32(buffer[28:32])
+		if header.Version == 0 {
+			// written before the format version field existed
+			header.Version = FormatVersion2
+		}
+	default:
+		return nil, ErrorInvalidStoreFile
+	}
+	switch header.Version {
+	case FormatVersion2, FormatVersion3:
+		header.Resolution = time.Duration(binary.LittleEndian.Uint64(buffer[16:24]))
+		header.Flags = binary.LittleEndian.Uint32(buffer[24:28])
+		// zero (protobuf) in files written before codecs were stored
+		header.Codec = binary.LittleEndian.Uint32(buffer[36:40])
+	default:
+		return nil, fmt.Errorf("unsupported storage file format version %d", header.Version)
+	}
+	if header.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unsupported storage file feature flags %#x", header.Flags&^knownFlags)
+	}
+	if header.Flags&FlagCompression != 0 {
+		header.Compression = Compression(binary.LittleEndian.Uint32(buffer[32:36]))
+		if err := checkCompression(header.Compression); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkResolution(header.Resolution); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// encode the file header in the current format
+func (header *fileHeader) encode() []byte {
+	buffer := make([]byte, FileHeaderSize)
+	binary.LittleEndian.PutUint64(buffer[0:], MagicCode)                   // file flags    offset + 0
+	binary.LittleEndian.PutUint64(buffer[8:], uint64(header.Baseline))     // timebaseline  offset + 8
+	binary.LittleEndian.PutUint64(buffer[16:], uint64(header.Resolution))  // resolution    offset + 16
+	binary.LittleEndian.PutUint32(buffer[24:], header.Flags)               // flags         offset + 24
+	binary.LittleEndian.PutUint32(buffer[28:], header.Version)             // version       offset + 28
+	binary.LittleEndian.PutUint32(buffer[32:], uint32(header.Compression)) // compression   offset + 32
+	binary.LittleEndian.PutUint32(buffer[36:], header.Codec)               // codec         offset + 36
+	return buffer
+}
+
+// set up the file layout from the header
+func (sf *storeFile) applyHeader(header *fileHeader) {
+	sf.version = header.Version
+	sf.resolution = header.Resolution
+	sf.flags = header.Flags
+	sf.compression = header.Compression
+	sf.codecID = header.Codec
+	sf.timelines = int64(TimestampOf1Day / header.Resolution)
+	sf.headerSize = FileHeaderSize
+	if header.Version == FormatVersion1 {
+		sf.headerSize = LegacyFileHeaderSize
+	}
+	sf.addressSize = 8
+	sf.mateInfoSize = MateInfoSize64
+	sf.recordSize = DataHeaderLen64
+	if header.Version < FormatVersion3 {
+		sf.addressSize = 4
+		sf.mateInfoSize = MateInfoSize
+		sf.recordSize = DataHeaderLen
+	}
+	if header.Flags&FlagChecksum != 0 {
+		sf.recordSize += 4
+	}
+}
+
+// time base line of the storage file name "<timestamp>.bin"
+func parseStorageFileName(filename string) (int64, error) {
+	name := filepath.Base(filename)
+	timebaseline, err := strconv.ParseInt(strings.TrimSuffix(name, ".bin"), 10, 64)
+	if err != nil || !strings.HasSuffix(name, ".bin") {
+		return 0, fmt.Errorf("%s is not a storage file", filename)
+	}
+	return timebaseline, nil
+}
+
+// Rewrite a storage file of an older format version into the current format.
+// an empty dst rewrites the file in place, otherwise the new file is written to dst and src is left untouched.
+// the file must not be opened by a database, returns false when the file is already in the current format
+func MigrateFile(src string, dst string) (bool, error) {
+	timebaseline, err := parseStorageFileName(src)
+	if err != nil {
+		return false, err
+	}
+	file, err := loadStoreFile(src, timebaseline, &dbOptions{}, false)
+	if err != nil {
+		return false, err
+	}
+	source := file.(*storeFile)
+	if source.version == CurrentFormatVersion {
+		source.Close()
+		return false, nil
+	}
+	target := dst
+	if target == "" {
+		target = src + ".migrate"
+	}
+	err = source.migrateTo(target)
+	source.Close()
+	if err != nil {
+		os.Remove(target)
+		return false, err
+	}
+	if dst == "" {
+		if err = os.Rename(target, src); err != nil {
+			return false, err
+		}
+		// the records moved, the index is built again on the next use
+		os.Remove(indexFileName(src))
+	}
+	return true, nil
+}
+
+// copy every record chain into a new file of the current format.
+// the frames of a delta file refer to their base frame by address and the records move, every frame is written as a keyframe
+func (sf *storeFile) migrateTo(filename string) error {
+	target := storeFile{TimelineBegin: sf.TimelineBegin, TimelineEnd: sf.TimelineEnd}
+	delta := sf.flags&FlagDelta != 0
+	if err := target.init(filename, newFileHeader(sf.TimelineBegin, sf.resolution, sf.compression, delta, sf.codecID)); err != nil {
+		return err
+	}
+	defer target.file.Close()
+	position, err := target.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(target.file, 1<<20)
+	// the index table is read and written in chunks of indexTableChunk timelines, empty chunks are left sparse
+	for first := int64(0); first < sf.timelines; first += indexTableChunk {
+		last := first + indexTableChunk - 1
+		if last >= sf.timelines {
+			last = sf.timelines - 1
+		}
+		metas, err := sf.readIndexTable(first, last)
+		if err != nil {
+			return err
+		}
+		table := make([]byte, int64(len(metas))*target.mateInfoSize)
+		used := false
+		for i := range metas {
+			if metas[i].TLFirst == 0 {
+				continue
+			}
+			var copied *timelineMateInfo
+			if copied, position, err = sf.migrateChain(&target, writer, first+int64(i), metas[i].TLFirst, position, delta); err != nil {
+				return err
+			}
+			target.encodeMateInfo(table[int64(i)*target.mateInfoSize:], copied)
+			used = true
+		}
+		if !used {
+			continue
+		}
+		if _, err = target.file.WriteAt(table, target.headerSize+first*target.mateInfoSize); err != nil {
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	return target.file.Sync()
+}
+
+// copy the record chain of the timeline at index starting at address to the end of the target file at position,
+// returns the meta information of the copied chain and the position after it
+func (sf *storeFile) migrateChain(target *storeFile, writer *bufio.Writer, index int64, address int64, position int64, delta bool) (*timelineMateInfo, int64, error) {
+	chain := make([]*recordHeader, 0)
+	for next := address; next != 0; {
+		header, err := sf.readRecordHeader(next)
+		if err != nil {
+			return nil, position, err
+		}
+		if header.Timeline != sf.tickOf(index) {
+			return nil, position, sf.corruptRecord(header, "record timestamp does not match the timeline, repair the file before migrating")
+		}
+		// records are appended, a chain always points forward
+		if header.Next != 0 && header.Next <= header.Address {
+			return nil, position, sf.corruptRecord(header, "next record points backward, repair the file before migrating")
+		}
+		chain = append(chain, header)
+		next = header.Next
+	}
+	meta := &timelineMateInfo{TLFirst: position}
+	for i, header := range chain {
+		data, err := sf.readRecordData(header)
+		if err == nil && delta {
+			var items []deltaItem
+			if items, err = sf.frameItems(header, data); err == nil {
+				data, err = target.keyframe(items)
+			}
+		}
+		if err != nil {
+			return nil, position, err
+		}
+		meta.TLLast = position
+		recordEnd := position + target.recordSize + int64(len(data))
+		var next int64 = 0
+		if i < len(chain)-1 {
+			next = recordEnd
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, recordEnd-position))
+		target.writeRecord(buf, target.tickOf(index), next, data)
+		if _, err = writer.Write(buf.Bytes()); err != nil {
+			return nil, position, err
+		}
+		position = recordEnd
+	}
+	return meta, position, nil
+}
+
+// rewrite the storage files of older format versions into the current format, returns the migrated files
+func (db *defaultDB) Migrate() ([]string, error) {
+	baselines, err := db.storageBaselines()
+	if err != nil {
+		return nil, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	migrated := make([]string, 0)
+	for _, timebaseline := range baselines {
+		if file := db.opendFiles[timebaseline]; file != nil {
+			file.Close()
+			delete(db.opendFiles, timebaseline)
+		}
+		filename := db.storageFileName(timebaseline)
+		ok, err := MigrateFile(filename, "")
+		if err != nil {
+			return migrated, err
+		}
+		if ok {
+			migrated = append(migrated, filename)
+		}
+	}
+	return migrated, nil
+}
@@ -0,0 +1,771 @@
+package snapsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// secondary index format
+// =============================
+// the sidecar file "<timestamp>.idx" maps the value of the indexed field of every stored
+// object to the record holding the object.
+//
+// magic code     size 4 byte    "SID2"
+// field number   size 4 byte    number of the indexed field, 0 before the first write
+// covered size   size 8 byte    every record before this storage file address is indexed
+// length         size 8 byte    length of the blocks, anything after it (but the directory) is discarded
+// directory      size 8 byte    size of the term directory following the blocks, 0 without one
+// blocks         previous block 8 byte | first index 8 byte | last index 8 byte | count 4 byte | size 4 byte |
+//                term (uvarint length + bytes) | entries of size bytes
+// entry          timeline index uvarint | record address uvarint | ordinal uvarint
+// directory      term count uvarint | terms (uvarint length + bytes | last block uvarint) | crc32 4 byte
+//
+// the term is the wire encoded value of the field, objects without the field (or with the zero value)
+// have an empty term. the ordinal is the position of the object in the record, the records of
+// compressed and delta files hold every object of one write.
+// the blocks of a term are chained from its last block through the previous block (0 for the first one),
+// only the last block of every term is kept in memory and a lookup reads the blocks of its terms.
+// new entries are collected in memory and written as one block per term every indexFlushEntries entries,
+// the header is updated last. records after the covered size are indexed again before the index is used,
+// so are the collected entries lost when the process stops.
+// the directory is written on close and dropped on open, without it the blocks are read once to find the last ones.
+// =============================
+
+// secondary index magic code "SID2", index files of the first format are built again
+const indexMagicCode = uint32(0x32444953)
+
+const indexHeaderSize = int64(32)
+
+const indexBlockHeaderSize = int64(32)
+
+// entries collected in memory before they are written
+const indexFlushEntries = 4096
+
+var ErrorNoIndex = errors.New("the database has no secondary index, see WithIndex")
+
+var errorIndexDamaged = errors.New("damaged index file")
+
+// an indexed object
+type indexEntry struct {
+	index   int64 // timeline index
+	address int64 // record address
+	ordinal int   // position of the object in the record
+}
+
+// the header of a block of entries of one term
+type indexBlock struct {
+	previous int64 // address of the previous block of the term, 0 for the first one
+	first    int64 // smallest timeline index of the entries
+	last     int64 // largest timeline index of the entries
+	count    uint32
+	size     uint32 // size of the entries
+}
+
+type secondaryIndex struct {
+	file    *os.File
+	number  protowire.Number        // indexed field number
+	covered int64                   // records before this address are indexed, written or collected
+	length  int64                   // length of the blocks
+	heads   map[string]int64        // last block of every term, nil until the blocks are read
+	pending map[string][]indexEntry // collected entries by term, not written yet
+	count   int                     // number of collected entries
+	mutex   sync.Mutex              // queries share the storage file lock, the index has its own
+}
+
+// index file name of the storage file
+func indexFileName(filename string) string {
+	return strings.TrimSuffix(filename, ".bin") + ".idx"
+}
+
+// open the index file of a storage file, the file is created when it does not exist
+func openSecondaryIndex(filename string) (*secondaryIndex, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		return nil, err
+	}
+	ix := &secondaryIndex{file: file, pending: make(map[string][]indexEntry)}
+	header := make([]byte, indexHeaderSize)
+	if readsize, _ := file.ReadAt(header, 0); readsize == len(header) && binary.LittleEndian.Uint32(header) == indexMagicCode &&
+		int64(binary.LittleEndian.Uint64(header[16:])) >= indexHeaderSize {
+		ix.number = protowire.Number(binary.LittleEndian.Uint32(header[4:]))
+		ix.covered = int64(binary.LittleEndian.Uint64(header[8:]))
+		ix.length = int64(binary.LittleEndian.Uint64(header[16:]))
+		if directory := int64(binary.LittleEndian.Uint64(header[24:])); directory > 0 {
+			ix.heads = ix.readDirectory(directory)
+		} else if ix.length == indexHeaderSize {
+			ix.heads = make(map[string]int64)
+		}
+		// drop blocks appended by an interrupted write and the directory, blocks are appended from now on
+		if err = file.Truncate(ix.length); err == nil {
+			err = ix.writeHeader(0)
+		}
+	} else {
+		err = ix.reset(0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+// drop every entry, the records are indexed again for the field number
+func (ix *secondaryIndex) reset(number protowire.Number) error {
+	ix.number, ix.covered, ix.length = number, 0, indexHeaderSize
+	ix.heads = make(map[string]int64)
+	ix.pending, ix.count = make(map[string][]indexEntry), 0
+	if err := ix.file.Truncate(indexHeaderSize); err != nil {
+		return err
+	}
+	return ix.writeHeader(0)
+}
+
+func (ix *secondaryIndex) writeHeader(directory int64) error {
+	header := make([]byte, indexHeaderSize)
+	binary.LittleEndian.PutUint32(header, indexMagicCode)
+	binary.LittleEndian.PutUint32(header[4:], uint32(ix.number))
+	binary.LittleEndian.PutUint64(header[8:], uint64(ix.covered))
+	binary.LittleEndian.PutUint64(header[16:], uint64(ix.length))
+	binary.LittleEndian.PutUint64(header[24:], uint64(directory))
+	_, err := ix.file.WriteAt(header, 0)
+	return err
+}
+
+// the last blocks of the terms saved by close, nil when the directory is damaged
+func (ix *secondaryIndex) readDirectory(size int64) map[string]int64 {
+	stat, err := ix.file.Stat()
+	if err != nil || size < 5 || ix.length+size > stat.Size() {
+		return nil
+	}
+	buffer := make([]byte, size)
+	if _, err = ix.file.ReadAt(buffer, ix.length); err != nil {
+		return nil
+	}
+	body := buffer[:size-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buffer[size-4:]) {
+		return nil
+	}
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return nil
+	}
+	body = body[n:]
+	heads := make(map[string]int64, count)
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil
+		}
+		term := string(body[n : n+int(length)])
+		body = body[n+int(length):]
+		head, m := binary.Uvarint(body)
+		if m <= 0 || int64(head) < indexHeaderSize || int64(head) >= ix.length {
+			return nil
+		}
+		body = body[m:]
+		heads[term] = int64(head)
+	}
+	return heads
+}
+
+// drop every entry of the index, the records are indexed again on the next use
+func (ix *secondaryIndex) clear() error {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	return ix.reset(ix.number)
+}
+
+// write the collected entries and the term directory, the directory saves reading the blocks on the next open
+func (ix *secondaryIndex) close() error {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	var err error
+	if ix.heads != nil {
+		if err = ix.flush(); err == nil {
+			err = ix.writeDirectory()
+		}
+	}
+	if closeErr := ix.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (ix *secondaryIndex) writeDirectory() error {
+	buffer := appendUvarint(make([]byte, 0, len(ix.heads)*16), uint64(len(ix.heads)))
+	for term, head := range ix.heads {
+		buffer = appendBytes(buffer, []byte(term))
+		buffer = appendUvarint(buffer, uint64(head))
+	}
+	buffer = appendFixed(buffer, uint64(crc32.ChecksumIEEE(buffer)), 4)
+	if _, err := ix.file.WriteAt(buffer, ix.length); err != nil {
+		return err
+	}
+	return ix.writeHeader(int64(len(buffer)))
+}
+
+// read the blocks once to find the last block of every term, a damaged index file is built again from the records
+func (ix *secondaryIndex) loadHeads() error {
+	if ix.heads != nil {
+		return nil
+	}
+	heads := make(map[string]int64)
+	reader := bufio.NewReaderSize(io.NewSectionReader(ix.file, indexHeaderSize, ix.length-indexHeaderSize), 1<<16)
+	header := make([]byte, indexBlockHeaderSize)
+	for address := indexHeaderSize; address < ix.length; {
+		_, err := io.ReadFull(reader, header)
+		block, ok := parseIndexBlock(header, address)
+		var length uint64
+		if err == nil && ok {
+			length, err = binary.ReadUvarint(reader)
+		}
+		end := address + indexBlockHeaderSize + int64(len(appendUvarint(nil, length))) + int64(length) + int64(block.size)
+		if err != nil || !ok || end > ix.length {
+			return ix.reset(ix.number)
+		}
+		term := make([]byte, length)
+		if _, err = io.ReadFull(reader, term); err == nil {
+			_, err = reader.Discard(int(block.size))
+		}
+		if err != nil {
+			return ix.reset(ix.number)
+		}
+		heads[string(term)] = address
+		address = end
+	}
+	ix.heads = heads
+	return nil
+}
+
+// the block header at the address, false when it can not belong to the index
+func parseIndexBlock(header []byte, address int64) (indexBlock, bool) {
+	block := indexBlock{
+		previous: int64(binary.LittleEndian.Uint64(header)),
+		first:    int64(binary.LittleEndian.Uint64(header[8:])),
+		last:     int64(binary.LittleEndian.Uint64(header[16:])),
+		count:    binary.LittleEndian.Uint32(header[24:]),
+		size:     binary.LittleEndian.Uint32(header[28:]),
+	}
+	ok := block.previous < address && (block.previous == 0 || block.previous >= indexHeaderSize) && block.first <= block.last
+	return block, ok
+}
+
+// write the collected entries as one block per term, the header is updated last
+func (ix *secondaryIndex) flush() error {
+	terms := make([]string, 0, len(ix.pending))
+	for term := range ix.pending {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	buffer := make([]byte, 0, ix.count*8+len(terms)*48)
+	heads := make(map[string]int64, len(terms))
+	for _, term := range terms {
+		entries := ix.pending[term]
+		block := indexBlock{previous: ix.heads[term], first: entries[0].index, last: entries[0].index, count: uint32(len(entries))}
+		payload := make([]byte, 0, len(entries)*8)
+		for _, entry := range entries {
+			if entry.index < block.first {
+				block.first = entry.index
+			}
+			if entry.index > block.last {
+				block.last = entry.index
+			}
+			payload = appendUvarint(payload, uint64(entry.index))
+			payload = appendUvarint(payload, uint64(entry.address))
+			payload = appendUvarint(payload, uint64(entry.ordinal))
+		}
+		block.size = uint32(len(payload))
+		heads[term] = ix.length + int64(len(buffer))
+		buffer = appendFixed(buffer, uint64(block.previous), 8)
+		buffer = appendFixed(buffer, uint64(block.first), 8)
+		buffer = appendFixed(buffer, uint64(block.last), 8)
+		buffer = appendFixed(buffer, uint64(block.count), 4)
+		buffer = appendFixed(buffer, uint64(block.size), 4)
+		buffer = appendBytes(buffer, []byte(term))
+		buffer = append(buffer, payload...)
+	}
+	if _, err := ix.file.WriteAt(buffer, ix.length); err != nil {
+		return err
+	}
+	ix.length += int64(len(buffer))
+	for term, head := range heads {
+		ix.heads[term] = head
+	}
+	ix.pending, ix.count = make(map[string][]indexEntry), 0
+	return ix.writeHeader(0)
+}
+
+// index the records between the covered size and size, the index is reset when it was built for another field
+func (ix *secondaryIndex) prepare(sf *storeFile, number protowire.Number, size int64) error {
+	if ix.number != number {
+		if err := ix.reset(number); err != nil {
+			return err
+		}
+	}
+	if err := ix.loadHeads(); err != nil {
+		return err
+	}
+	if ix.covered < sf.dataOffset() {
+		ix.covered = sf.dataOffset()
+	}
+	if ix.covered >= size {
+		return nil
+	}
+	terms := make([][]byte, 0)
+	entries := make([]indexEntry, 0)
+	for address := ix.covered; address < size; {
+		header, err := sf.readRecordHeader(address)
+		if err != nil || header.endAddress() > size {
+			break
+		}
+		address = header.endAddress()
+		index := header.Timeline - sf.tickOf(0)
+		if index < 0 || index >= sf.timelines {
+			break
+		}
+		data, err := sf.readRecordData(header)
+		if err != nil {
+			continue
+		}
+		objects, err := sf.recordObjects(header, data)
+		if err != nil {
+			continue
+		}
+		for ordinal, object := range objects {
+			for _, term := range indexTerms(object, number) {
+				terms = append(terms, term)
+				entries = append(entries, indexEntry{index: index, address: header.Address, ordinal: ordinal})
+			}
+		}
+		if len(entries) >= indexFlushEntries {
+			// the entries of a large file are written on the way, not collected at once
+			if err = ix.append(terms, entries, address); err != nil {
+				return err
+			}
+			terms, entries = terms[:0], entries[:0]
+		}
+	}
+	// an unreadable tail is skipped, it is not indexed again on every use
+	return ix.append(terms, entries, size)
+}
+
+// collect the entries of the objects, every record before covered is indexed afterwards
+func (ix *secondaryIndex) append(terms [][]byte, entries []indexEntry, covered int64) error {
+	for i, entry := range entries {
+		ix.pending[string(terms[i])] = append(ix.pending[string(terms[i])], entry)
+	}
+	ix.count += len(entries)
+	ix.covered = covered
+	if ix.count >= indexFlushEntries {
+		return ix.flush()
+	}
+	return nil
+}
+
+// visit the entries of the term between the timeline indexes, the collected entries first and the blocks from the last one.
+// the caller holds the index lock, visit returns false to skip the remaining entries
+func (ix *secondaryIndex) walkTerm(term string, beginIndex int64, endIndex int64, visit func(entry indexEntry) bool) error {
+	for _, entry := range ix.pending[term] {
+		if entry.index >= beginIndex && entry.index <= endIndex && !visit(entry) {
+			return nil
+		}
+	}
+	header := make([]byte, indexBlockHeaderSize)
+	termSize := int64(len(appendBytes(nil, []byte(term))))
+	for address := ix.heads[term]; address != 0; {
+		if _, err := ix.file.ReadAt(header, address); err != nil {
+			return errorIndexDamaged
+		}
+		block, ok := parseIndexBlock(header, address)
+		offset := address + indexBlockHeaderSize + termSize
+		if !ok || offset+int64(block.size) > ix.length {
+			return errorIndexDamaged
+		}
+		if block.last >= beginIndex && block.first <= endIndex {
+			payload := make([]byte, block.size)
+			if _, err := ix.file.ReadAt(payload, offset); err != nil {
+				return errorIndexDamaged
+			}
+			for i := uint32(0); i < block.count; i++ {
+				values := make([]uint64, 3)
+				for j := range values {
+					value, n := binary.Uvarint(payload)
+					if n <= 0 {
+						return errorIndexDamaged
+					}
+					values[j], payload = value, payload[n:]
+				}
+				entry := indexEntry{index: int64(values[0]), address: int64(values[1]), ordinal: int(values[2])}
+				if entry.index >= beginIndex && entry.index <= endIndex && !visit(entry) {
+					return nil
+				}
+			}
+		}
+		address = block.previous
+	}
+	return nil
+}
+
+// run read on the index of the file, a damaged index file is built again from the records and read again
+func (ix *secondaryIndex) read(sf *storeFile, number protowire.Number, read func() error) error {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	if err := ix.prepare(sf, number, sf.size); err != nil {
+		return err
+	}
+	err := read()
+	if err != errorIndexDamaged {
+		return err
+	}
+	if err = ix.reset(number); err == nil {
+		err = ix.prepare(sf, number, sf.size)
+	}
+	if err == nil {
+		err = read()
+	}
+	return err
+}
+
+// the entries of the terms between the timeline indexes, in timeline order
+func (ix *secondaryIndex) lookup(sf *storeFile, number protowire.Number, terms []string, beginIndex int64, endIndex int64) ([]indexEntry, error) {
+	var entries []indexEntry
+	err := ix.read(sf, number, func() error {
+		entries = make([]indexEntry, 0)
+		for _, term := range terms {
+			if err := ix.walkTerm(term, beginIndex, endIndex, func(entry indexEntry) bool {
+				entries = append(entries, entry)
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// entries are in write order, timelines may be written out of order
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].index != entries[j].index {
+			return entries[i].index < entries[j].index
+		}
+		if entries[i].address != entries[j].address {
+			return entries[i].address < entries[j].address
+		}
+		return entries[i].ordinal < entries[j].ordinal
+	})
+	return entries, nil
+}
+
+// the terms of the index accepted by match in ascending order, only the terms are read
+func (ix *secondaryIndex) matchTerms(sf *storeFile, number protowire.Number, match func(term string) bool) ([]string, error) {
+	var terms []string
+	err := ix.read(sf, number, func() error {
+		terms = make([]string, 0)
+		for term := range ix.heads {
+			if match(term) {
+				terms = append(terms, term)
+			}
+		}
+		for term := range ix.pending {
+			if _, ok := ix.heads[term]; !ok && match(term) {
+				terms = append(terms, term)
+			}
+		}
+		return nil
+	})
+	sort.Strings(terms)
+	return terms, err
+}
+
+// the term has entries between the timeline indexes
+func (ix *secondaryIndex) contains(sf *storeFile, number protowire.Number, term string, beginIndex int64, endIndex int64) (bool, error) {
+	found := false
+	err := ix.read(sf, number, func() error {
+		found = false
+		return ix.walkTerm(term, beginIndex, endIndex, func(entry indexEntry) bool {
+			found = true
+			return false
+		})
+	})
+	return found, err
+}
+
+// index the objects of a committed write, the records of a failed update are indexed by the next prepare
+func (ix *secondaryIndex) add(sf *storeFile, number protowire.Number, index int64, addresses []int64, objects [][]byte) error {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	// index the records written before this write first
+	if err := ix.prepare(sf, number, addresses[0]); err != nil {
+		return err
+	}
+	terms := make([][]byte, 0, len(objects))
+	entries := make([]indexEntry, 0, len(objects))
+	for i, object := range objects {
+		entry := indexEntry{index: index, address: addresses[0], ordinal: i}
+		if len(addresses) > 1 {
+			// one record per object
+			entry.address, entry.ordinal = addresses[i], 0
+		}
+		for _, term := range indexTerms(object, number) {
+			terms = append(terms, term)
+			entries = append(entries, entry)
+		}
+	}
+	return ix.append(terms, entries, sf.size)
+}
+
+// the terms of the marshaled object, one term of the indexed field or the terms of the tags of a data point
+func indexTerms(data []byte, number protowire.Number) [][]byte {
+	if number == tagIndexNumber {
+		return pointTagTerms(data)
+	}
+	return [][]byte{indexTerm(data, number)}
+}
+
+// the term of the indexed field in the marshaled object, the wire encoded value of the last occurrence
+func indexTerm(data []byte, number protowire.Number) []byte {
+	var term []byte
+	for len(data) > 0 {
+		fieldNumber, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil
+		}
+		m := protowire.ConsumeFieldValue(fieldNumber, kind, data[n:])
+		if m < 0 {
+			return nil
+		}
+		if fieldNumber == number {
+			term = data[n : n+m]
+			if kind == protowire.BytesType {
+				term, _ = protowire.ConsumeBytes(term)
+			}
+		}
+		data = data[n+m:]
+	}
+	// the zero value of a field with explicit presence is the same term as a missing field
+	for _, b := range term {
+		if b != 0 {
+			return term
+		}
+	}
+	return nil
+}
+
+// the index field of the message and the term of the value
+func indexKey(descriptor protoreflect.MessageDescriptor, field string, prototype protoreflect.Message, value interface{}) (protowire.Number, []byte, error) {
+	fd := descriptor.Fields().ByName(protoreflect.Name(field))
+	if fd == nil {
+		fd = descriptor.Fields().ByJSONName(field)
+	}
+	if fd == nil || fd.IsList() || fd.IsMap() || fd.Message() != nil {
+		return 0, nil, fmt.Errorf("index field %s is not a scalar field of %s", field, descriptor.FullName())
+	}
+	fieldValue, err := scalarValue(fd, value)
+	if err != nil {
+		return 0, nil, err
+	}
+	message := prototype.New()
+	message.Set(fd, fieldValue)
+	data, err := deterministic.Marshal(message.Interface())
+	if err != nil {
+		return 0, nil, err
+	}
+	return fd.Number(), indexTerm(data, fd.Number()), nil
+}
+
+// the index field number of the message
+func indexNumberOf(descriptor protoreflect.MessageDescriptor, field string) (protowire.Number, error) {
+	if field == tagIndexField {
+		return tagIndexNumber, nil
+	}
+	fd := descriptor.Fields().ByName(protoreflect.Name(field))
+	if fd == nil {
+		fd = descriptor.Fields().ByJSONName(field)
+	}
+	if fd == nil || fd.IsList() || fd.IsMap() || fd.Message() != nil {
+		return 0, fmt.Errorf("index field %s is not a scalar field of %s", field, descriptor.FullName())
+	}
+	return fd.Number(), nil
+}
+
+// convert a go value to the value of the scalar field
+func scalarValue(fd protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	v := reflect.ValueOf(value)
+	var integer int64
+	var unsigned uint64
+	var float float64
+	isNumber := true
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer, unsigned, float = v.Int(), uint64(v.Int()), float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer, unsigned, float = int64(v.Uint()), v.Uint(), float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		integer, unsigned, float = int64(v.Float()), uint64(v.Float()), v.Float()
+	default:
+		isNumber = false
+	}
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if v.Kind() == reflect.Bool {
+			return protoreflect.ValueOfBool(v.Bool()), nil
+		}
+	case protoreflect.StringKind:
+		if v.Kind() == reflect.String {
+			return protoreflect.ValueOfString(v.String()), nil
+		}
+	case protoreflect.BytesKind:
+		if data, ok := value.([]byte); ok {
+			return protoreflect.ValueOfBytes(data), nil
+		}
+	case protoreflect.EnumKind:
+		if v.Kind() == reflect.String {
+			if enumValue := fd.Enum().Values().ByName(protoreflect.Name(v.String())); enumValue != nil {
+				return protoreflect.ValueOfEnum(enumValue.Number()), nil
+			}
+		} else if isNumber {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(integer)), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if isNumber {
+			return protoreflect.ValueOfInt32(int32(integer)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if isNumber {
+			return protoreflect.ValueOfInt64(integer), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if isNumber {
+			return protoreflect.ValueOfUint32(uint32(unsigned)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if isNumber {
+			return protoreflect.ValueOfUint64(unsigned), nil
+		}
+	case protoreflect.FloatKind:
+		if isNumber {
+			return protoreflect.ValueOfFloat32(float32(float)), nil
+		}
+	case protoreflect.DoubleKind:
+		if isNumber {
+			return protoreflect.ValueOfFloat64(float), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("%v (%T) is not a value of the %s field %s", value, value, fd.Kind(), fd.Name())
+}
+
+// walk the objects whose index field has the value between begin and end in time order, across the storage files of every day.
+// the records are found through the secondary index of every file, see storeFile.walkRange for visit and decode
+func (db *defaultDB) walkIndex(begin time.Time, end time.Time, prototype protoreflect.Message, value interface{}, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+	if db.options.index == "" {
+		return ErrorNoIndex
+	}
+	defer db.stats.observeQuery(time.Now())
+	if end.Before(begin) {
+		return errors.New("is not a valid time range")
+	}
+	number, term, err := indexKey(prototype.Descriptor(), db.options.index, prototype, value)
+	if err != nil {
+		return err
+	}
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		next, err := file.(*storeFile).walkIndex(begin, end, number, term, visit, decode)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk the indexed objects with the term between begin and end, only the records holding them are read
+func (sf *storeFile) walkIndex(begin time.Time, end time.Time, number protowire.Number, term []byte, visit func(timeline time.Time) bool, decode func(data []byte) error) (bool, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return false, ErrorFileClosed
+	}
+	if sf.index == nil {
+		return false, ErrorNoIndex
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return true, nil
+	}
+	entries, err := sf.index.lookup(sf, number, []string{string(term)}, beginIndex, endIndex)
+	if err != nil {
+		return false, err
+	}
+	return sf.walkEntries(entries, func(object []byte) bool {
+		return string(indexTerm(object, number)) == string(term)
+	}, visit, decode)
+}
+
+// read the objects of the index entries in order, objects that accept rejects do not match the index and are skipped
+func (sf *storeFile) walkEntries(entries []indexEntry, accept func(object []byte) bool, visit func(timeline time.Time) bool, decode func(data []byte) error) (bool, error) {
+	buffer := make([]byte, 0, 4096)
+	var objects [][]byte
+	var objectsAddress int64
+	for i, entry := range entries {
+		if i == 0 || entry.index != entries[i-1].index {
+			if !visit(sf.timelineOf(entry.index)) {
+				return false, nil
+			}
+		}
+		if objects == nil || objectsAddress != entry.address {
+			header, err := sf.readRecordHeader(entry.address)
+			if err != nil {
+				return false, err
+			}
+			data, err := sf.readRecordDataTo(header, buffer)
+			if err == nil {
+				buffer = data
+				objects, err = sf.recordObjects(header, data)
+			}
+			if err != nil {
+				objects = nil
+				if err = sf.corrupt(err); err != nil {
+					return false, err
+				}
+				continue
+			}
+			objectsAddress = entry.address
+		}
+		if entry.ordinal >= len(objects) || !accept(objects[entry.ordinal]) {
+			// the index does not match the file, the entry is skipped
+			continue
+		}
+		err := decode(objects[entry.ordinal])
+		if err == errorStopIteration {
+			return false, nil
+		}
+		if err != nil {
+			header := &recordHeader{Address: entry.address, Timeline: sf.tickOf(entry.index)}
+			if err = sf.corrupt(sf.corruptRecord(header, "unmarshal: "+err.Error())); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,163 @@
+package snapsdb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// returned by the walk callback when the iteration is stopped
+var errorStopIteration = errors.New("iteration stopped")
+
+// implemented by the database, the generic query functions walk the timelines through it
+type rangeWalker interface {
+	walkRange(begin time.Time, end time.Time, empty bool, visit func(timeline time.Time) bool, decode func(data []byte) error) error
+	rangeSource(begin time.Time, end time.Time, resolution time.Duration) (rangeWalker, error)
+	walkIndex(begin time.Time, end time.Time, prototype protoreflect.Message, value interface{}, visit func(timeline time.Time) bool, decode func(data []byte) error) error
+	walkTags(begin time.Time, end time.Time, matchers []*tagMatcher, visit func(timeline time.Time) bool, decode func(data []byte) error) error
+	objectCodec() Codec
+	checkSchema(begin time.Time, end time.Time, descriptor protoreflect.MessageDescriptor) error
+	schemas(begin time.Time, end time.Time) (map[int64]protoreflect.MessageDescriptor, error)
+}
+
+// call fn with every object between begin and end in time order, across the storage files of every day.
+// message is reused for every object, clone it with proto.Clone to keep it after fn returns.
+// the iteration stops when fn returns false, fn must not write to the database
+func (db *defaultDB) Iterate(begin time.Time, end time.Time, message StoreData, fn func(timeline time.Time, message StoreData) bool) error {
+	source, err := db.source(begin, end, 0)
+	if err == nil {
+		err = source.checkSchema(begin, end, message.ProtoReflect().Descriptor())
+	}
+	if err != nil {
+		return err
+	}
+	var current time.Time
+	return source.walkRange(begin, end, false, func(timeline time.Time) bool {
+		current = timeline
+		return true
+	}, func(data []byte) error {
+		if err := source.options.codec.Unmarshal(data, message); err != nil {
+			return err
+		}
+		if !fn(current, message) {
+			return errorStopIteration
+		}
+		return nil
+	})
+}
+
+func (db *defaultDB) IterateUnix(begin int64, end int64, message StoreData, fn func(timeline time.Time, message StoreData) bool) error {
+	return db.Iterate(time.Unix(begin, 0), time.Unix(end, 0), message, fn)
+}
+
+// walk the timelines between begin and end in time order across the storage files of every day, see storeFile.walkRange.
+// with empty, days without a storage file yield the empty timelines of the database resolution
+func (db *defaultDB) walkRange(begin time.Time, end time.Time, empty bool, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+	defer db.stats.observeQuery(time.Now())
+	return db.walkDays(begin, end, empty, visit, decode)
+}
+
+// walkRange without recording a query, used by the background rollup
+func (db *defaultDB) walkDays(begin time.Time, end time.Time, empty bool, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+	if end.Before(begin) {
+		return errors.New("is not a valid time range")
+	}
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			if empty && !visitEmptyDay(timebasetime, begin, end, db.options.resolution, visit) {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		next, err := file.(*storeFile).walkRange(begin, end, empty, visit, decode)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// visit the timelines of a day without storage file, returns false when visit stopped the walk
+func visitEmptyDay(day time.Time, begin time.Time, end time.Time, resolution time.Duration, visit func(timeline time.Time) bool) bool {
+	timeline := day
+	if begin.After(day) {
+		timeline = day.Add(begin.Sub(day) / resolution * resolution)
+	}
+	dayEnd := day.Add(TimestampOf1Day)
+	for ; timeline.Before(dayEnd) && !timeline.After(end); timeline = timeline.Add(resolution) {
+		if !visit(timeline) {
+			return false
+		}
+	}
+	return true
+}
+
+// call fn with every object of the timelines between begin and end, returns false when fn stopped the iteration.
+// the file keeps the read lock while fn runs
+func (sf *storeFile) Iterate(begin time.Time, end time.Time, message StoreData, fn func(timeline time.Time, message StoreData) bool) (bool, error) {
+	var current time.Time
+	return sf.walkRange(begin, end, false, func(timeline time.Time) bool {
+		current = timeline
+		return true
+	}, func(data []byte) error {
+		if err := sf.codec.Unmarshal(data, message); err != nil {
+			return err
+		}
+		if !fn(current, message) {
+			return errorStopIteration
+		}
+		return nil
+	})
+}
+
+// walk the timelines between begin and end in time order, visit is called before the objects of a timeline
+// are passed to decode. timelines without records are only visited with empty.
+// visit returning false or decode returning errorStopIteration stops the walk and false is returned,
+// other decode errors are corrupt records. the data passed to decode is only valid during the call
+func (sf *storeFile) walkRange(begin time.Time, end time.Time, empty bool, visit func(timeline time.Time) bool, decode func(data []byte) error) (bool, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return false, ErrorFileClosed
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return true, nil
+	}
+	// one read buffer for every record of the range
+	buffer := make([]byte, 0, 4096)
+	for index := beginIndex; index <= endIndex; index++ {
+		if !empty {
+			meta, err := sf.readMateInfo(index)
+			if err != nil {
+				return false, err
+			}
+			if meta.TLFirst == 0 {
+				continue
+			}
+		}
+		if !visit(sf.timelineOf(index)) {
+			return false, nil
+		}
+		err := sf.walkTimeline(index, &buffer, func(header *recordHeader, data []byte) error {
+			err := decode(data)
+			if err != nil && err != errorStopIteration {
+				return sf.corrupt(sf.corruptRecord(header, "unmarshal: "+err.Error()))
+			}
+			return err
+		})
+		if err == errorStopIteration {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
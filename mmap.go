@@ -0,0 +1,42 @@
+package snapsdb
+
+// the mapping of a growing file is extended once this many bytes were appended,
+// the newest records are read with ReadAt in between
+const remapThreshold = 4 << 20
+
+// read len(buffer) bytes at offset, from the memory mapping when the range is mapped, otherwise from the file
+func (sf *storeFile) readAt(buffer []byte, offset int64) (int, error) {
+	end := offset + int64(len(buffer))
+	if offset >= 0 && end <= int64(len(sf.mapped)) {
+		return copy(buffer, sf.mapped[offset:end]), nil
+	}
+	return sf.file.ReadAt(buffer, offset)
+}
+
+// a growing file is remapped in steps of remapThreshold, sealed files are mapped completely when opened
+func (sf *storeFile) shouldRemap() bool {
+	return sf.size-int64(len(sf.mapped)) >= remapThreshold
+}
+
+// map the file up to its current size, the file is read with ReadAt when it can not be mapped.
+// must hold the write lock, queries read the mapping under the read lock
+func (sf *storeFile) remap() {
+	sf.unmap()
+	if sf.size <= 0 {
+		return
+	}
+	data, err := mmapFile(sf.file, sf.size)
+	if err != nil {
+		sf.mmap = false
+		return
+	}
+	sf.mapped = data
+}
+
+// release the mapping, must be done before the file is truncated or closed
+func (sf *storeFile) unmap() {
+	if sf.mapped != nil {
+		munmapFile(sf.mapped)
+		sf.mapped = nil
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package snapsdb
+
+import (
+	"errors"
+	"os"
+)
+
+var errorMmapUnsupported = errors.New("memory mapped files are not supported on this platform")
+
+// the file is always read with ReadAt
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errorMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errorMmapUnsupported
+}
@@ -1,6 +1,9 @@
 package snapsdb
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Option func(*dbOptions)
 
@@ -24,3 +27,94 @@ func WithTimeKeyFormat(value string) Option {
 		s.timekeyformat = value
 	}
 }
+
+/* The duration of one timeline, must divide one second evenly and not be less than 1ms (e.g. 1s, 100ms, 10ms), or be whole seconds dividing one day evenly (e.g. 1m, 1h), existing storage files keep the resolution of their header. default(time.Second) */
+func WithTimeResolution(value time.Duration) Option {
+	return func(s *dbOptions) {
+		s.resolution = value
+	}
+}
+
+func checkResolution(resolution time.Duration) error {
+	if resolution > time.Second {
+		if resolution%time.Second != 0 || TimestampOf1Day%resolution != 0 {
+			return fmt.Errorf("invalid time resolution %v, must be whole seconds dividing one day evenly", resolution)
+		}
+		return nil
+	}
+	if resolution < time.Millisecond || time.Second%resolution != 0 {
+		return fmt.Errorf("invalid time resolution %v, must divide one second evenly and not be less than 1ms", resolution)
+	}
+	return nil
+}
+
+/* Flush the write ahead log and the storage file to disk on every write, survives power loss at the cost of write speed. default(false) */
+func WithSyncWrite(value bool) Option {
+	return func(s *dbOptions) {
+		s.syncWrite = value
+	}
+}
+
+/* Called with every corrupt record found by a query, the record is skipped and the query goes on. default(nil, the query returns a *CorruptRecordError) */
+func WithCorruptRecordHandler(handler func(err *CorruptRecordError)) Option {
+	return func(s *dbOptions) {
+		s.onCorrupt = handler
+	}
+}
+
+/* Compression of new storage files, the objects of one write are compressed together into one record. default(CompressionNone) */
+func WithCompression(value Compression) Option {
+	return func(s *dbOptions) {
+		s.compression = value
+	}
+}
+
+/* Store every write of new storage files as the difference to the previous write, the objects are matched by the identity field (e.g. "pid", empty matches by position), a full snapshot is stored every keyframeInterval writes. default(disabled) */
+func WithDeltaEncoding(identityField string, keyframeInterval int) Option {
+	return func(s *dbOptions) {
+		s.identity = identityField
+		s.keyframes = keyframeInterval
+	}
+}
+
+/* Read storage files through a read-only memory mapping instead of one ReadAt per record, the file is read with ReadAt when mapping is not supported. default(true) */
+func WithMemoryMap(value bool) Option {
+	return func(s *dbOptions) {
+		s.mmap = value
+	}
+}
+
+/* Keep a secondary index on a field of the objects (e.g. "pid") for QueryIndex, stored beside every storage file in "<timestamp>.idx". default("", no index) */
+func WithIndex(field string) Option {
+	return func(s *dbOptions) {
+		s.index = field
+	}
+}
+
+/* Keep an index of the tags of the data points (see WritePoints) for QueryPoints with WithTag, WithTagIn or WithTagRegex and for TagKeys and TagValues, it replaces WithIndex. default(false) */
+func WithTagIndex() Option {
+	return func(s *dbOptions) {
+		s.index = tagIndexField
+	}
+}
+
+/* Codec of the objects, stored in the header of new storage files, see Codec. the secondary index, delta encoding, rollup tiers and data points need the protobuf codec. default(ProtobufCodec) */
+func WithCodec(codec Codec) Option {
+	return func(s *dbOptions) {
+		s.codec = codec
+	}
+}
+
+/* Keep rollup tiers of coarser timelines computed in the background from the stored data, each with its own retention, see rollup.go. default(none) */
+func WithRollup(tiers ...RollupTier) Option {
+	return func(s *dbOptions) {
+		s.tiers = append(s.tiers, tiers...)
+	}
+}
+
+/* Range queries read the finest of the database and its rollup tiers with at most maxTimelines timelines in the range. default(3600) */
+func WithRollupSelection(maxTimelines int) Option {
+	return func(s *dbOptions) {
+		s.rollupTimelines = maxTimelines
+	}
+}
@@ -0,0 +1,435 @@
+package snapsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// data points
+// =============================
+// a DataPoint is stored without a protobuf schema, every point is one record holding a bytes message (field 1)
+// with the self-describing encoding of the point:
+//
+//	point := version(1) | pairs(tags) | pairs(values)
+//	pairs := uvarint(count) | { string(key) | value }   keys in ascending order
+//	value := kind(1) | payload
+//
+// integers keep their go type, structs are stored as maps of their exported fields and read back as
+// map[string]interface{}, slices other than []byte are read back as []interface{}, time.Time is read back
+// in the local time zone
+// =============================
+
+var ErrorInvalidPoint = errors.New("invalid data point encoding")
+
+var ErrorPointCodec = errors.New("data points are stored by databases with the protobuf codec")
+
+// version of the data point encoding
+const pointVersion = byte(1)
+
+// value kinds of the data point encoding
+const (
+	pointNil byte = iota
+	pointString
+	pointBool
+	pointInt
+	pointInt8
+	pointInt16
+	pointInt32
+	pointInt64
+	pointUint
+	pointUint8
+	pointUint16
+	pointUint32
+	pointUint64
+	pointFloat32
+	pointFloat64
+	pointTime
+	pointBytes
+	pointMap
+	pointList
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// nesting of maps, lists and structs in the values of a point, deeper values (e.g. a struct pointing to itself) are rejected
+const pointMaxDepth = 32
+
+// write one or more data points to the timeline, see QueryPoints
+/*
+	@example
+	db.WritePoints(time.Now(), &snapsdb.DataPoint{
+		Tags:   snapsdb.TagPair{"host": "web-1"},
+		Values: snapsdb.ValuePair{"cpu": 12.5, "disk": map[string]interface{}{"free": uint64(1 << 30)}},
+	})
+*/
+func (db *defaultDB) WritePoints(timeline time.Time, points ...*DataPoint) error {
+	if db.options.codec.ID() != CodecProtobuf {
+		return ErrorPointCodec
+	}
+	data := make([]StoreData, 0, len(points))
+	for _, point := range points {
+		buffer, err := encodePoint(point)
+		if err != nil {
+			return err
+		}
+		data = append(data, &wrapperspb.BytesValue{Value: buffer})
+	}
+	return db.Write(timeline, data...)
+}
+
+func (db *defaultDB) WritePointsUnix(timeline int64, points ...*DataPoint) error {
+	return db.WritePoints(time.Unix(timeline, 0), points...)
+}
+
+// query the data points of a certain time interval page by page like QueryRange, WithTag, WithTagIn and WithTagRegex
+// select the points by their tags through the tag index (see WithTagIndex) or by reading every point without it.
+// WithFilter and WithFieldFilter are not supported for data points
+/*
+	@example
+	page, err := snapsdb.QueryPoints(db, beginTimestamp, endTimestamp, snapsdb.WithPageSize(60))
+	page, err := snapsdb.QueryPoints(db, beginTimestamp, endTimestamp, snapsdb.WithTag("host", "web-01"), snapsdb.WithTagIn("role", "api", "web"))
+	for _, timeline := range page.Timelines {
+		fmt.Println(timeline.Timeline, timeline.Data[0].Values["cpu"])
+	}
+*/
+func QueryPoints(db SnapsDB, begin time.Time, end time.Time, opts ...QueryOption) (*RangeResult[DataPoint], error) {
+	walker, ok := db.(rangeWalker)
+	if !ok {
+		return nil, errors.New("range queries are not supported by the database")
+	}
+	options := newQueryOptions(opts)
+	if len(options.filters) > 0 || len(options.expressions) > 0 {
+		return nil, errors.New("filters are not supported for data points, see WithTag")
+	}
+	for _, matcher := range options.tags {
+		if matcher.err != nil {
+			return nil, matcher.err
+		}
+	}
+	walker, err := walker.rangeSource(begin, end, options.resolution)
+	if err != nil {
+		return nil, err
+	}
+	if walker.objectCodec().ID() != CodecProtobuf {
+		return nil, ErrorPointCodec
+	}
+	if err = walker.checkSchema(begin, end, (&wrapperspb.BytesValue{}).ProtoReflect().Descriptor()); err != nil {
+		return nil, err
+	}
+	walk := func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+		return walker.walkRange(begin, end, options.empty, visit, decode)
+	}
+	if len(options.tags) > 0 {
+		options.empty = false
+		walk = func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+			return walker.walkTags(begin, end, options.tags, visit, decode)
+		}
+	}
+	record := &wrapperspb.BytesValue{}
+	return collectTimelines(options, begin, end, walk, func(data []byte, point *DataPoint) (bool, error) {
+		if err := proto.Unmarshal(data, record); err != nil {
+			return false, err
+		}
+		decoded, err := decodePoint(record.Value)
+		if err != nil {
+			return false, err
+		}
+		for _, matcher := range options.tags {
+			if !matcher.matchPoint(decoded) {
+				return false, nil
+			}
+		}
+		*point = *decoded
+		return true, nil
+	})
+}
+
+// the self-describing encoding of the point
+func encodePoint(point *DataPoint) ([]byte, error) {
+	if point == nil {
+		return nil, errors.New("nil data point")
+	}
+	buffer := []byte{pointVersion}
+	for name, value := range point.Tags {
+		if err := checkTag(name, value); err != nil {
+			return nil, err
+		}
+	}
+	buffer, err := appendPointPairs(buffer, reflect.ValueOf(map[string]interface{}(point.Tags)), 0)
+	if err != nil {
+		return nil, err
+	}
+	return appendPointPairs(buffer, reflect.ValueOf(map[string]interface{}(point.Values)), 0)
+}
+
+// tags are scalars
+func checkTag(name string, value interface{}) error {
+	if strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("tag %q: the key contains a NUL byte", name)
+	}
+	v := util.Indirect(reflect.ValueOf(value))
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return fmt.Errorf("tag %q: %T is not a scalar value", name, value)
+	case reflect.Struct:
+		if v.Type() != timeType {
+			return fmt.Errorf("tag %q: %T is not a scalar value", name, value)
+		}
+	}
+	return nil
+}
+
+// the entries of a map with string keys in key order, depth is the nesting of the map
+func appendPointPairs(buffer []byte, v reflect.Value, depth int) ([]byte, error) {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	buffer = appendUvarint(buffer, uint64(len(keys)))
+	for _, key := range keys {
+		buffer = appendPointString(buffer, key.String())
+		var err error
+		if buffer, err = appendPointValue(buffer, v.MapIndex(key), key.String(), depth); err != nil {
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
+func appendPointValue(buffer []byte, v reflect.Value, name string, depth int) ([]byte, error) {
+	v = util.Indirect(v)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		if depth >= pointMaxDepth && v.Type() != timeType {
+			return nil, fmt.Errorf("value %q: nested deeper than %d levels", name, pointMaxDepth)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(buffer, pointNil), nil
+	case reflect.String:
+		return appendPointString(append(buffer, pointString), v.String()), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buffer, pointBool, 1), nil
+		}
+		return append(buffer, pointBool, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		kind := map[reflect.Kind]byte{reflect.Int: pointInt, reflect.Int8: pointInt8, reflect.Int16: pointInt16, reflect.Int32: pointInt32, reflect.Int64: pointInt64}[v.Kind()]
+		return appendVarint(append(buffer, kind), v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		kind := map[reflect.Kind]byte{reflect.Uint: pointUint, reflect.Uint8: pointUint8, reflect.Uint16: pointUint16, reflect.Uint32: pointUint32, reflect.Uint64: pointUint64}[v.Kind()]
+		return appendUvarint(append(buffer, kind), v.Uint()), nil
+	case reflect.Float32:
+		return appendFixed(append(buffer, pointFloat32), uint64(math.Float32bits(float32(v.Float()))), 4), nil
+	case reflect.Float64:
+		return appendFixed(append(buffer, pointFloat64), math.Float64bits(v.Float()), 8), nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("value %q: map keys of %v are not strings", name, v.Type())
+		}
+		return appendPointPairs(append(buffer, pointMap), v, depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return appendPointBytes(append(buffer, pointBytes), data), nil
+		}
+		buffer = appendUvarint(append(buffer, pointList), uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buffer, err = appendPointValue(buffer, v.Index(i), name, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			return appendUvarint(appendVarint(append(buffer, pointTime), t.Unix()), uint64(t.Nanosecond())), nil
+		}
+		// the exported fields, like TraverseStruct
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.PkgPath == "" {
+				fields[field.Name] = v.Field(i).Interface()
+			}
+		}
+		return appendPointPairs(append(buffer, pointMap), reflect.ValueOf(fields), depth+1)
+	}
+	return nil, fmt.Errorf("value %q: unsupported type %v", name, v.Type())
+}
+
+func appendVarint(buffer []byte, value int64) []byte {
+	data := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(data, value)
+	return append(buffer, data[:n]...)
+}
+
+// the little endian value in size bytes
+func appendFixed(buffer []byte, value uint64, size int) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return append(buffer, data[:size]...)
+}
+
+func appendPointString(buffer []byte, value string) []byte {
+	return append(appendUvarint(buffer, uint64(len(value))), value...)
+}
+
+func appendPointBytes(buffer []byte, value []byte) []byte {
+	return append(appendUvarint(buffer, uint64(len(value))), value...)
+}
+
+// decode the self-describing encoding of a point
+func decodePoint(data []byte) (*DataPoint, error) {
+	if len(data) == 0 || data[0] != pointVersion {
+		return nil, ErrorInvalidPoint
+	}
+	reader := &pointReader{data: data[1:]}
+	tags := reader.pairs()
+	values := reader.pairs()
+	if reader.err != nil || len(reader.data) != 0 {
+		return nil, ErrorInvalidPoint
+	}
+	return &DataPoint{Tags: TagPair(tags), Values: ValuePair(values)}, nil
+}
+
+// reads the point encoding, the first error is kept and every later read returns the zero value
+type pointReader struct {
+	data  []byte
+	err   error
+	depth int // nesting of the value being read
+}
+
+func (r *pointReader) fail() {
+	r.err = ErrorInvalidPoint
+	r.data = nil
+}
+
+func (r *pointReader) next(n uint64) []byte {
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.fail()
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *pointReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *pointReader) varint() int64 {
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+// a count of entries, each entry takes at least one byte
+func (r *pointReader) count() int {
+	count := r.uvarint()
+	if count > uint64(len(r.data)) {
+		r.fail()
+		return 0
+	}
+	return int(count)
+}
+
+func (r *pointReader) pairs() map[string]interface{} {
+	count := r.count()
+	pairs := make(map[string]interface{}, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		key := string(r.next(r.uvarint()))
+		pairs[key] = r.value()
+	}
+	return pairs
+}
+
+func (r *pointReader) value() interface{} {
+	kind := r.next(1)
+	if r.err != nil {
+		return nil
+	}
+	switch kind[0] {
+	case pointNil:
+		return nil
+	case pointString:
+		return string(r.next(r.uvarint()))
+	case pointBool:
+		if value := r.next(1); value != nil {
+			return value[0] != 0
+		}
+	case pointInt:
+		return int(r.varint())
+	case pointInt8:
+		return int8(r.varint())
+	case pointInt16:
+		return int16(r.varint())
+	case pointInt32:
+		return int32(r.varint())
+	case pointInt64:
+		return r.varint()
+	case pointUint:
+		return uint(r.uvarint())
+	case pointUint8:
+		return uint8(r.uvarint())
+	case pointUint16:
+		return uint16(r.uvarint())
+	case pointUint32:
+		return uint32(r.uvarint())
+	case pointUint64:
+		return r.uvarint()
+	case pointFloat32:
+		if value := r.next(4); value != nil {
+			return math.Float32frombits(binary.LittleEndian.Uint32(value))
+		}
+	case pointFloat64:
+		if value := r.next(8); value != nil {
+			return math.Float64frombits(binary.LittleEndian.Uint64(value))
+		}
+	case pointTime:
+		seconds := r.varint()
+		return time.Unix(seconds, int64(r.uvarint()))
+	case pointBytes:
+		return append([]byte{}, r.next(r.uvarint())...)
+	case pointMap, pointList:
+		if r.depth >= pointMaxDepth {
+			r.fail()
+			return nil
+		}
+		r.depth++
+		defer func() { r.depth-- }()
+		if kind[0] == pointMap {
+			return r.pairs()
+		}
+		count := r.count()
+		list := make([]interface{}, 0, count)
+		for i := 0; i < count && r.err == nil; i++ {
+			list = append(list, r.value())
+		}
+		return list
+	default:
+		r.fail()
+	}
+	return nil
+}
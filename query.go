@@ -0,0 +1,326 @@
+package snapsdb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var ErrorInvalidToken = errors.New("invalid continuation token")
+
+// the objects of one timeline
+type TimelineData[T any] struct {
+	Timeline time.Time // begin time of the timeline
+	Data     []T
+}
+
+// a page of a range query, the timelines are in time order
+type RangeResult[T any] struct {
+	Timelines []TimelineData[T]
+	// pass to WithContinuation to query the next page, empty when the range is complete
+	Next string
+}
+
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	empty       bool
+	pageSize    int
+	token       string
+	filters     []func(message StoreData) bool
+	expressions []string
+	groupBy     string
+	resolution  time.Duration
+	tags        []*tagMatcher
+}
+
+func newQueryOptions(opts []QueryOption) *queryOptions {
+	options := &queryOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// the filter of the query compiled for the message type, nil when every object is returned
+func (o *queryOptions) filter(descriptor protoreflect.MessageDescriptor) (func(message StoreData) bool, error) {
+	if len(o.filters) == 0 && len(o.expressions) == 0 {
+		return nil, nil
+	}
+	if descriptor == nil {
+		return nil, errors.New("filters are only supported for protobuf messages")
+	}
+	filters := o.filters
+	for _, text := range o.expressions {
+		expression, err := compileFieldExpression(text, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, func(message StoreData) bool {
+			return expression.match(message.ProtoReflect())
+		})
+	}
+	return func(message StoreData) bool {
+		for _, filter := range filters {
+			if !filter(message) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+/* Return the timelines without data as well, with an empty Data slice. default(false) */
+func WithEmptyTimelines() QueryOption {
+	return func(o *queryOptions) {
+		o.empty = true
+	}
+}
+
+/* The maximum number of timelines of one page, RangeResult.Next continues the query. default(0, no limit) */
+func WithPageSize(value int) QueryOption {
+	return func(o *queryOptions) {
+		o.pageSize = value
+	}
+}
+
+/* Keep only the objects the predicate returns true for, the predicate gets the decoded message. every filter of the query must match */
+func WithFilter(predicate func(message StoreData) bool) QueryOption {
+	return func(o *queryOptions) {
+		o.filters = append(o.filters, predicate)
+	}
+}
+
+/* Keep only the objects matching the field expression, e.g. `pid == 1234`, `name startswith "java" && cpu > 80`, see filter.go */
+func WithFieldFilter(expression string) QueryOption {
+	return func(o *queryOptions) {
+		o.expressions = append(o.expressions, expression)
+	}
+}
+
+/* Read the database (its resolution) or the rollup tier of the resolution instead of selecting one by the range width. default(0, automatic) */
+func WithResolution(value time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.resolution = value
+	}
+}
+
+/* Continue a range query from the RangeResult.Next token of the previous page, with the same begin and end */
+func WithContinuation(token string) QueryOption {
+	return func(o *queryOptions) {
+		o.token = token
+	}
+}
+
+// Query a certain timeline data of the database, T is the generated protobuf message struct
+/*
+	@example
+	list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, timestamp)
+	list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, timestamp, snapsdb.WithFieldFilter("cpu > 80"))
+*/
+func QueryTimeline[T any, PT interface {
+	*T
+	proto.Message
+}](db SnapsDB, timeline time.Time, opts ...QueryOption) ([]T, error) {
+	result, err := QueryRange[T, PT](db, timeline, timeline, opts...)
+	if err != nil || len(result.Timelines) == 0 {
+		return make([]T, 0), err
+	}
+	return result.Timelines[0].Data, nil
+}
+
+// query the data of a certain time interval, the timelines with data are returned in time order
+/*
+	@example
+	timelines, err := snapsdb.QueryBetween[types.ProcessInfo](db, beginTimestamp, endTimestamp)
+	for _, timeline := range timelines {
+		fmt.Println(timeline.Timeline, len(timeline.Data))
+	}
+*/
+func QueryBetween[T any, PT interface {
+	*T
+	proto.Message
+}](db SnapsDB, begin time.Time, end time.Time, opts ...QueryOption) ([]TimelineData[T], error) {
+	result, err := QueryRange[T, PT](db, begin, end, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return result.Timelines, nil
+}
+
+// query the data of a certain time interval page by page, the timelines are returned in time order
+/*
+	@example
+	var token string
+	for {
+		page, err := snapsdb.QueryRange[types.ProcessInfo](db, begin, end, snapsdb.WithPageSize(60), snapsdb.WithContinuation(token))
+		if err != nil {
+			return err
+		}
+		draw(page.Timelines)
+		if token = page.Next; token == "" {
+			break
+		}
+	}
+*/
+func QueryRange[T any, PT interface {
+	*T
+	proto.Message
+}](db SnapsDB, begin time.Time, end time.Time, opts ...QueryOption) (*RangeResult[T], error) {
+	walker, ok := db.(rangeWalker)
+	if !ok {
+		return nil, errors.New("range queries are not supported by the database")
+	}
+	options := newQueryOptions(opts)
+	walker, err := walker.rangeSource(begin, end, options.resolution)
+	if err == nil {
+		err = walker.checkSchema(begin, end, PT(new(T)).ProtoReflect().Descriptor())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return collectRange[T, PT](options, walker.objectCodec(), begin, end, func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+		return walker.walkRange(begin, end, options.empty, visit, decode)
+	})
+}
+
+// query the objects of a certain time interval page by page like QueryRange, decoded by the codec of the database
+// (see WithCodec) into T, which does not have to be a protobuf message. WithFilter and WithFieldFilter are not supported
+/*
+	@example
+	db, err := snapsdb.InitDB(snapsdb.WithCodec(snapsdb.JSONCodec))
+	db.WriteObjects(time.Now(), &Sample{Host: "web-1", Load: 0.5})
+	page, err := snapsdb.QueryObjects[Sample](db, beginTimestamp, endTimestamp)
+*/
+func QueryObjects[T any](db SnapsDB, begin time.Time, end time.Time, opts ...QueryOption) (*RangeResult[T], error) {
+	walker, ok := db.(rangeWalker)
+	if !ok {
+		return nil, errors.New("range queries are not supported by the database")
+	}
+	options := newQueryOptions(opts)
+	if len(options.filters) > 0 || len(options.expressions) > 0 {
+		return nil, errors.New("filters are only supported for protobuf messages")
+	}
+	walker, err := walker.rangeSource(begin, end, options.resolution)
+	if err != nil {
+		return nil, err
+	}
+	if message, ok := interface{}(new(T)).(StoreData); ok {
+		if err = walker.checkSchema(begin, end, message.ProtoReflect().Descriptor()); err != nil {
+			return nil, err
+		}
+	}
+	codec := walker.objectCodec()
+	return collectTimelines(options, begin, end, func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+		return walker.walkRange(begin, end, options.empty, visit, decode)
+	}, func(data []byte, element *T) (bool, error) {
+		return true, codec.Unmarshal(data, element)
+	})
+}
+
+// query the objects whose index field (see WithIndex) has the value, the records are found through the
+// secondary index instead of reading every timeline. the timelines with matching objects are returned
+// in time order, page by page like QueryRange, WithEmptyTimelines has no effect
+/*
+	@example
+	page, err := snapsdb.QueryIndex[types.ProcessInfo](db, begin, end, int32(1234))
+*/
+func QueryIndex[T any, PT interface {
+	*T
+	proto.Message
+}](db SnapsDB, begin time.Time, end time.Time, value interface{}, opts ...QueryOption) (*RangeResult[T], error) {
+	walker, ok := db.(rangeWalker)
+	if !ok {
+		return nil, errors.New("index queries are not supported by the database")
+	}
+	options := newQueryOptions(opts)
+	options.empty = false
+	prototype := PT(new(T)).ProtoReflect()
+	if err := walker.checkSchema(begin, end, prototype.Descriptor()); err != nil {
+		return nil, err
+	}
+	return collectRange[T, PT](options, walker.objectCodec(), begin, end, func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+		return walker.walkIndex(begin, end, prototype, value, visit, decode)
+	})
+}
+
+// collect the objects of a walk into timelines, walk is called with the begin time of the page
+func collectRange[T any, PT interface {
+	*T
+	proto.Message
+}](options *queryOptions, codec Codec, begin time.Time, end time.Time, walk func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error) (*RangeResult[T], error) {
+	filter, err := options.filter(PT(new(T)).ProtoReflect().Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	return collectTimelines(options, begin, end, walk, func(data []byte, element *T) (bool, error) {
+		message := PT(element)
+		if err := codec.Unmarshal(data, message); err != nil {
+			return false, err
+		}
+		return filter == nil || filter(message), nil
+	})
+}
+
+// collect the objects of a walk into timelines, decode fills the new element and reports whether it is kept
+func collectTimelines[T any](options *queryOptions, begin time.Time, end time.Time, walk func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error, decode func(data []byte, element *T) (bool, error)) (*RangeResult[T], error) {
+	if options.token != "" {
+		next, err := decodeToken(options.token)
+		if err != nil || next.Before(begin) || next.After(end) {
+			return nil, ErrorInvalidToken
+		}
+		begin = next
+	}
+	result := &RangeResult[T]{Timelines: make([]TimelineData[T], 0)}
+	var current *TimelineData[T]
+	// drop the last timeline when it has no data and empty timelines are not wanted
+	flush := func() {
+		if current != nil && !options.empty && len(current.Data) == 0 {
+			result.Timelines = result.Timelines[:len(result.Timelines)-1]
+		}
+		current = nil
+	}
+	err := walk(begin, func(timeline time.Time) bool {
+		flush()
+		if options.pageSize > 0 && len(result.Timelines) >= options.pageSize {
+			result.Next = encodeToken(timeline)
+			return false
+		}
+		result.Timelines = append(result.Timelines, TimelineData[T]{Timeline: timeline, Data: make([]T, 0)})
+		current = &result.Timelines[len(result.Timelines)-1]
+		return true
+	}, func(data []byte) error {
+		// decode into the new element, nothing is copied
+		var zero T
+		current.Data = append(current.Data, zero)
+		keep, err := decode(data, &current.Data[len(current.Data)-1])
+		if err != nil || !keep {
+			current.Data = current.Data[:len(current.Data)-1]
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	return result, nil
+}
+
+// the begin time of the next timeline, encoded as base64 nanoseconds
+func encodeToken(timeline time.Time) string {
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, uint64(timeline.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func decodeToken(token string) (time.Time, error) {
+	buffer, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buffer) != 8 {
+		return time.Time{}, ErrorInvalidToken
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(buffer))), nil
+}
@@ -0,0 +1,341 @@
+package snapsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// rollup tiers
+// =============================
+// a rollup tier is a database of coarser timelines in the directory "rollup-<resolution>" of the data path,
+// e.g. "rollup-1m0s", with its own retention. every timeline of a tier holds the objects returned by the
+// reducer of the tier for the raw objects of that timeline.
+//
+// tier timelines are computed in the background once they are complete, raw data written into a computed
+// tier timeline afterwards is not rolled up. the progress of every tier is kept in "rollup.state",
+// timelines that already have data are never computed twice.
+//
+// range queries read the finest of the database and its tiers that still keeps the begin of the range and
+// has at most WithRollupSelection timelines in the range, WithResolution selects one explicitly.
+// =============================
+
+// interval of the background rollup
+var rollupInterval = time.Minute
+
+// reduce the raw objects of one tier timeline into the objects stored in the tier, objects are in time order
+type Reducer func(timeline time.Time, objects []StoreData) []StoreData
+
+// a rollup tier of the database
+type RollupTier struct {
+	Resolution time.Duration // duration of one tier timeline, a multiple of the database resolution
+	Retention  time.Duration // how long the tier keeps its storage files, must be positive
+	Message    StoreData     // message type the raw objects are decoded into
+	Reducer    Reducer       // see FieldReducer
+}
+
+// the function a FieldReducer applies to the numeric fields
+type RollupFunction int
+
+const (
+	RollupAvg RollupFunction = iota
+	RollupMin
+	RollupMax
+	RollupSum
+	RollupLast
+)
+
+type rollupTier struct {
+	RollupTier
+	db    *defaultDB
+	done  time.Time  // the tier timelines before done are computed
+	mutex sync.Mutex // one rollup of the tier at a time
+}
+
+// directory of the tier in the data path of the database
+func rollupDirectory(basePath string, resolution time.Duration) string {
+	return filepath.Join(basePath, fmt.Sprintf("rollup-%s", resolution))
+}
+
+// open the database of every configured tier
+func (db *defaultDB) openTiers() error {
+	tiers := append([]RollupTier{}, db.options.tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Resolution < tiers[j].Resolution })
+	for i, tier := range tiers {
+		if err := checkResolution(tier.Resolution); err != nil {
+			return err
+		}
+		if tier.Resolution <= db.options.resolution || tier.Resolution%db.options.resolution != 0 {
+			return fmt.Errorf("rollup resolution %v is not a multiple of the database resolution %v", tier.Resolution, db.options.resolution)
+		}
+		if i > 0 && tier.Resolution == tiers[i-1].Resolution {
+			return fmt.Errorf("more than one rollup tier of resolution %v", tier.Resolution)
+		}
+		if tier.Message == nil || tier.Reducer == nil {
+			return fmt.Errorf("rollup tier %v needs a message and a reducer", tier.Resolution)
+		}
+		if tier.Retention <= 0 {
+			return fmt.Errorf("rollup tier %v needs a positive retention, got %v", tier.Resolution, tier.Retention)
+		}
+		options := *db.options
+		options.dataPath = rollupDirectory(db.basePath, tier.Resolution)
+		options.resolution = tier.Resolution
+		options.retention = tier.Retention
+		options.identity, options.keyframes, options.index, options.tiers = "", 0, "", nil
+		tierDB, err := openDB(&options)
+		if err != nil {
+			return err
+		}
+		tierDB.stats = db.stats
+		db.tiers = append(db.tiers, &rollupTier{RollupTier: tier, db: tierDB})
+	}
+	return nil
+}
+
+// run Rollup every rollupInterval until the database is disposed
+func (db *defaultDB) startRollup() {
+	db.rollupQuit = make(chan struct{})
+	db.rollupDone = make(chan struct{})
+	go func() {
+		defer close(db.rollupDone)
+		ticker := time.NewTicker(rollupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.rollupQuit:
+				return
+			case <-ticker.C:
+				db.Rollup()
+			}
+		}
+	}()
+}
+
+// compute the complete tier timelines that are not computed yet, the background rollup calls it every minute
+func (db *defaultDB) Rollup() error {
+	now := time.Now()
+	for _, tier := range db.tiers {
+		if err := db.rollup(tier, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *defaultDB) rollup(tier *rollupTier, now time.Time) error {
+	tier.mutex.Lock()
+	defer tier.mutex.Unlock()
+	statefile := filepath.Join(tier.db.basePath, "rollup.state")
+	if tier.done.IsZero() {
+		if buffer, err := os.ReadFile(statefile); err == nil && len(buffer) == 8 {
+			tier.done = time.Unix(0, int64(binary.LittleEndian.Uint64(buffer)))
+		} else {
+			baselines, err := db.storageBaselines()
+			if err != nil || len(baselines) == 0 {
+				return err
+			}
+			tier.done = time.Unix(baselines[0], 0)
+		}
+	}
+	begin := tier.done
+	if oldest := alignTimeline(now.Add(-tier.Retention), tier.Resolution); begin.Before(oldest) {
+		begin = oldest
+	}
+	// the tier timeline of now is not complete
+	end := alignTimeline(now, tier.Resolution)
+	if !begin.Before(end) {
+		return nil
+	}
+	var bucket time.Time
+	objects := make([]StoreData, 0)
+	flush := func() error {
+		if len(objects) == 0 {
+			return nil
+		}
+		defer func() { objects = make([]StoreData, 0) }()
+		if computed, err := tier.db.hasData(bucket); err != nil || computed {
+			return err
+		}
+		if results := tier.Reducer(bucket, objects); len(results) > 0 {
+			return tier.db.Write(bucket, results...)
+		}
+		return nil
+	}
+	if err := db.checkSchema(begin, end.Add(-1), tier.Message.ProtoReflect().Descriptor()); err != nil {
+		return err
+	}
+	var failure error
+	err := db.walkDays(begin, end.Add(-1), false, func(timeline time.Time) bool {
+		if start := alignTimeline(timeline, tier.Resolution); !start.Equal(bucket) {
+			if failure = flush(); failure != nil {
+				return false
+			}
+			bucket = start
+		}
+		return true
+	}, func(data []byte) error {
+		message := tier.Message.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(data, message); err != nil {
+			return err
+		}
+		objects = append(objects, message)
+		return nil
+	})
+	if err == nil {
+		err = failure
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	tier.done = end
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, uint64(end.UnixNano()))
+	return os.WriteFile(statefile, buffer, 0777)
+}
+
+// the timeline already has records
+func (db *defaultDB) hasData(timeline time.Time) (bool, error) {
+	file, err := db.loadFile(util.GetUnixOfDay(timeline), false)
+	if err == ErrorDBFileNotHit {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	meta, err := file.ReadMateInfo(timeline)
+	if err != nil {
+		return false, err
+	}
+	return meta.TLFirst != 0, nil
+}
+
+// begin time of the timeline of the resolution holding t, timelines start at the begin of the day
+func alignTimeline(t time.Time, resolution time.Duration) time.Time {
+	day := util.GetTimeOfDay(t)
+	return day.Add(t.Sub(day) / resolution * resolution)
+}
+
+// the database or rollup tier a query between begin and end reads, see WithRollupSelection and WithResolution
+func (db *defaultDB) source(begin time.Time, end time.Time, resolution time.Duration) (*defaultDB, error) {
+	if resolution > 0 {
+		if resolution == db.options.resolution {
+			return db, nil
+		}
+		for _, tier := range db.tiers {
+			if tier.Resolution == resolution {
+				return tier.db, nil
+			}
+		}
+		return nil, fmt.Errorf("the database has no rollup tier of resolution %v", resolution)
+	}
+	if len(db.tiers) == 0 {
+		return db, nil
+	}
+	now := time.Now()
+	sources := []*defaultDB{db}
+	for _, tier := range db.tiers {
+		sources = append(sources, tier.db)
+	}
+	for i, source := range sources {
+		if i < len(sources)-1 && source.IsExpired(begin, &now) {
+			// the begin of the range is no longer kept
+			continue
+		}
+		if int64(end.Sub(begin)/source.options.resolution) <= int64(db.options.rollupTimelines) {
+			return source, nil
+		}
+	}
+	return sources[len(sources)-1], nil
+}
+
+// the range walker a range query reads, see defaultDB.source
+func (db *defaultDB) rangeSource(begin time.Time, end time.Time, resolution time.Duration) (rangeWalker, error) {
+	return db.source(begin, end, resolution)
+}
+
+// a reducer that reduces the objects sharing the value of the identity field (e.g. "pid", empty reduces all
+// objects into one) into one object, the numeric fields are reduced by function and the other fields keep the
+// value of the last object
+func FieldReducer(identity string, function RollupFunction) Reducer {
+	return func(timeline time.Time, objects []StoreData) []StoreData {
+		groups := make(map[string][]StoreData)
+		order := make([]string, 0)
+		for _, object := range objects {
+			key := ""
+			if identity != "" {
+				if path, err := resolveFieldPath(object.ProtoReflect().Descriptor(), identity); err == nil {
+					key = fmt.Sprint(fieldValueOf(object.ProtoReflect(), path).Interface())
+				}
+			}
+			if groups[key] == nil {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], object)
+		}
+		results := make([]StoreData, 0, len(order))
+		for _, key := range order {
+			results = append(results, reduceFields(groups[key], function))
+		}
+		return results
+	}
+}
+
+// reduce the numeric top level fields of the objects into a copy of the last object
+func reduceFields(objects []StoreData, function RollupFunction) StoreData {
+	result := proto.Clone(objects[len(objects)-1])
+	message := result.ProtoReflect()
+	if function == RollupLast {
+		return result
+	}
+	fields := message.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.IsList() || fd.IsMap() || !isNumericKind(fd.Kind()) {
+			continue
+		}
+		aggregate := &Aggregate{}
+		for _, object := range objects {
+			aggregate.add(numericValue(fd, object.ProtoReflect().Get(fd)))
+		}
+		value := aggregate.Avg()
+		switch function {
+		case RollupMin:
+			value = aggregate.Min
+		case RollupMax:
+			value = aggregate.Max
+		case RollupSum:
+			value = aggregate.Sum
+		}
+		message.Set(fd, numericFieldValue(fd, value))
+	}
+	return result
+}
+
+// the value of the numeric field closest to value
+func numericFieldValue(fd protoreflect.FieldDescriptor, value float64) protoreflect.Value {
+	switch fd.Kind() {
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(float32(value))
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(value)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(int32(math.Round(value)))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(uint32(math.Round(value)))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(uint64(math.Round(value)))
+	}
+	return protoreflect.ValueOfInt64(int64(math.Round(value)))
+}
@@ -0,0 +1,345 @@
+package snapsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// schema format
+// =============================
+// the sidecar file "<timestamp>.schema" records the protobuf message type of the objects of a storage file,
+// it is written by the first write of protobuf messages and replaced when a compatible version of the message
+// declaring every recorded field and more is written. files written before schemas were recorded have no schema
+// and are not checked, a damaged schema file is treated as missing and recorded again by the next write.
+//
+// magic code     size 4 byte    "SSCH"
+// message name   uvarint length + fully-qualified message name
+// descriptors    serialized FileDescriptorSet of the file declaring the message and its imports
+//
+// a message type is compatible with the schema when it has the same name and every field number both
+// declare has the same wire encoding and cardinality, see compatibleFields.
+// =============================
+
+// schema magic code "SSCH"
+const schemaMagicCode = uint32(0x48435353)
+
+var ErrorNoSchema = errors.New("the storage file has no schema")
+
+// the message type of a query or write does not match the schema of a storage file
+type SchemaError struct {
+	File     string // schema file name of the storage file
+	Recorded string // message name of the schema
+	Expected string // message name of the query or write
+	Reason   string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("schema %s records %s, %s is not compatible: %s", e.File, e.Recorded, e.Expected, e.Reason)
+}
+
+// schema file name of the storage file
+func schemaFileName(filename string) string {
+	return strings.TrimSuffix(filename, ".bin") + ".schema"
+}
+
+// read the schema of a storage file, nil when it has none
+func readSchema(filename string) (protoreflect.MessageDescriptor, error) {
+	buffer, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	damaged := fmt.Errorf("damaged schema file %s", filename)
+	if len(buffer) < 4 || binary.LittleEndian.Uint32(buffer) != schemaMagicCode {
+		return nil, damaged
+	}
+	length, n := binary.Uvarint(buffer[4:])
+	if n <= 0 || uint64(len(buffer)-4-n) < length {
+		return nil, damaged
+	}
+	name := protoreflect.FullName(buffer[4+n : 4+n+int(length)])
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(buffer[4+n+int(length):], set); err != nil {
+		return nil, damaged
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", damaged, err)
+	}
+	descriptor, err := files.FindDescriptorByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", damaged, err)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, damaged
+	}
+	return message, nil
+}
+
+// write the schema of the message type, the file is replaced at once
+func writeSchema(filename string, descriptor protoreflect.MessageDescriptor) error {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(file protoreflect.FileDescriptor)
+	add = func(file protoreflect.FileDescriptor) {
+		if seen[file.Path()] {
+			return
+		}
+		seen[file.Path()] = true
+		// imports first
+		for i := 0; i < file.Imports().Len(); i++ {
+			add(file.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(file))
+	}
+	add(descriptor.ParentFile())
+	descriptors, err := deterministic.Marshal(set)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 4, 4+len(descriptor.FullName())+len(descriptors)+binary.MaxVarintLen64)
+	binary.LittleEndian.PutUint32(buffer, schemaMagicCode)
+	buffer = appendBytes(buffer, []byte(descriptor.FullName()))
+	buffer = append(buffer, descriptors...)
+	tempfile := filename + ".tmp"
+	file, err := os.OpenFile(tempfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	// the content must reach the disk before the rename, a crash must not leave an empty schema
+	if _, err = file.Write(buffer); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempfile)
+		return err
+	}
+	return os.Rename(tempfile, filename)
+}
+
+// the message type is compatible with the schema, an empty reason when it is
+func schemaMismatch(recorded protoreflect.MessageDescriptor, expected protoreflect.MessageDescriptor) string {
+	if recorded.FullName() != expected.FullName() {
+		return "the message name differs"
+	}
+	return compatibleFields(recorded, expected)
+}
+
+// every field number of both messages has the same wire encoding and cardinality
+func compatibleFields(recorded protoreflect.MessageDescriptor, expected protoreflect.MessageDescriptor) string {
+	fields := expected.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		old := recorded.Fields().ByNumber(fd.Number())
+		if old == nil {
+			continue
+		}
+		switch {
+		case old.IsList() != fd.IsList() || old.IsMap() != fd.IsMap():
+			return fmt.Sprintf("field %d changed between repeated, map and single", fd.Number())
+		case wireKind(old.Kind()) != wireKind(fd.Kind()):
+			return fmt.Sprintf("field %d changed from %s to %s", fd.Number(), old.Kind(), fd.Kind())
+		case old.Message() != nil && fd.Message() != nil && old.Message().FullName() != fd.Message().FullName():
+			return fmt.Sprintf("field %d changed from %s to %s", fd.Number(), old.Message().FullName(), fd.Message().FullName())
+		}
+	}
+	return ""
+}
+
+// the message declares every field number of the recorded message
+func declaresFields(message protoreflect.MessageDescriptor, recorded protoreflect.MessageDescriptor) bool {
+	fields := recorded.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if message.Fields().ByNumber(fields.Get(i).Number()) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// kinds sharing a wire encoding are interchangeable
+func wireKind(kind protoreflect.Kind) protoreflect.Kind {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.BoolKind, protoreflect.EnumKind:
+		return protoreflect.Int64Kind
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return protoreflect.Sint64Kind
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.Fixed32Kind
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.Fixed64Kind
+	case protoreflect.StringKind:
+		return protoreflect.BytesKind
+	}
+	return kind
+}
+
+// record the message type of a write, the caller holds the write lock
+func (sf *storeFile) recordSchema(descriptor protoreflect.MessageDescriptor) error {
+	if sf.schema == descriptor {
+		return nil
+	}
+	if sf.schema != nil {
+		if reason := schemaMismatch(sf.schema, descriptor); reason != "" {
+			return &SchemaError{File: sf.schemaFile, Recorded: string(sf.schema.FullName()), Expected: string(descriptor.FullName()), Reason: reason}
+		}
+	}
+	// only a version declaring every recorded field and more replaces the schema, an older writer must not
+	// drop the fields of a newer one and writers of different versions must not replace it in turn
+	if sf.schema != nil && (descriptor.Fields().Len() <= sf.schema.Fields().Len() || !declaresFields(descriptor, sf.schema)) {
+		return nil
+	}
+	if err := writeSchema(sf.schemaFile, descriptor); err != nil {
+		return err
+	}
+	sf.schema = descriptor
+	return nil
+}
+
+// the message type of a query is compatible with the schema of the file
+func (sf *storeFile) checkSchema(descriptor protoreflect.MessageDescriptor) error {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.schema == nil || sf.schema == descriptor {
+		return nil
+	}
+	if reason := schemaMismatch(sf.schema, descriptor); reason != "" {
+		return &SchemaError{File: sf.schemaFile, Recorded: string(sf.schema.FullName()), Expected: string(descriptor.FullName()), Reason: reason}
+	}
+	return nil
+}
+
+// the message type of a query is compatible with the schema of every storage file between begin and end,
+// a nil descriptor (objects of another codec) is not checked
+func (db *defaultDB) checkSchema(begin time.Time, end time.Time, descriptor protoreflect.MessageDescriptor) error {
+	if descriptor == nil {
+		return nil
+	}
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = file.(*storeFile).checkSchema(descriptor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the message type recorded for the storage file of the day of timeline, ErrorNoSchema when none was recorded
+/*
+	@example
+	descriptor, err := db.Schema(timestamp)
+	fmt.Println(descriptor.FullName())
+*/
+func (db *defaultDB) Schema(timeline time.Time) (protoreflect.MessageDescriptor, error) {
+	file, err := db.loadFile(util.GetUnixOfDay(timeline), false)
+	if err != nil {
+		return nil, err
+	}
+	sf := file.(*storeFile)
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.schema == nil {
+		return nil, ErrorNoSchema
+	}
+	return sf.schema, nil
+}
+
+// query the objects of a certain time interval page by page like QueryRange without the generated go types,
+// every object is decoded into a dynamicpb message of the schema recorded for its storage file.
+// a storage file without a schema returns ErrorNoSchema
+/*
+	@example
+	page, err := snapsdb.QueryDynamic(db, beginTimestamp, endTimestamp, snapsdb.WithFieldFilter("cpu > 80"))
+	for _, timeline := range page.Timelines {
+		for _, message := range timeline.Data {
+			fmt.Println(protojson.Format(message))
+		}
+	}
+*/
+func QueryDynamic(db SnapsDB, begin time.Time, end time.Time, opts ...QueryOption) (*RangeResult[*dynamicpb.Message], error) {
+	walker, ok := db.(rangeWalker)
+	if !ok {
+		return nil, errors.New("range queries are not supported by the database")
+	}
+	options := newQueryOptions(opts)
+	walker, err := walker.rangeSource(begin, end, options.resolution)
+	if err != nil {
+		return nil, err
+	}
+	// the schemas are resolved before the walk, a decode error would be a corrupt record
+	schemas, err := walker.schemas(begin, end)
+	if err != nil {
+		return nil, err
+	}
+	filters := make(map[protoreflect.MessageDescriptor]func(message StoreData) bool)
+	for _, descriptor := range schemas {
+		if filters[descriptor], err = options.filter(descriptor); err != nil {
+			return nil, err
+		}
+	}
+	codec := walker.objectCodec()
+	var descriptor protoreflect.MessageDescriptor
+	missing := false
+	return collectTimelines(options, begin, end, func(begin time.Time, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+		err := walker.walkRange(begin, end, options.empty, func(timeline time.Time) bool {
+			descriptor = schemas[util.GetUnixOfDay(timeline)]
+			return visit(timeline)
+		}, decode)
+		if err == nil && missing {
+			return ErrorNoSchema
+		}
+		return err
+	}, func(data []byte, element **dynamicpb.Message) (bool, error) {
+		if descriptor == nil {
+			// the storage file was created after the schemas were resolved
+			missing = true
+			return false, errorStopIteration
+		}
+		message := dynamicpb.NewMessage(descriptor)
+		if err := codec.Unmarshal(data, message); err != nil {
+			return false, err
+		}
+		*element = message
+		filter := filters[descriptor]
+		return filter == nil || filter(message), nil
+	})
+}
+
+// the schema of every storage file between begin and end by time base line, ErrorNoSchema when a file has none
+func (db *defaultDB) schemas(begin time.Time, end time.Time) (map[int64]protoreflect.MessageDescriptor, error) {
+	schemas := make(map[int64]protoreflect.MessageDescriptor)
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		descriptor, err := db.Schema(timebasetime)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		schemas[timebasetime.Unix()] = descriptor
+	}
+	return schemas, nil
+}
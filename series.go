@@ -0,0 +1,86 @@
+package snapsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// a series name is a directory name
+var seriesNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// directory of the named series in the data path of the database
+func seriesDirectory(basePath string, name string) string {
+	return filepath.Join(basePath, "series", name)
+}
+
+func (db *defaultDB) Series(name string, opts ...Option) (SnapsDB, error) {
+	if !seriesNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid series name %q", name)
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.isDisposed {
+		return nil, errors.New("Database object has been destroyed")
+	}
+	if series := db.series[name]; series != nil {
+		return series, nil
+	}
+	options := *db.options
+	options.identity, options.keyframes, options.index, options.tiers = "", 0, "", nil
+	for _, opt := range opts {
+		opt(&options)
+	}
+	options.dataPath = seriesDirectory(db.basePath, name)
+	if err := checkOptions(&options); err != nil {
+		return nil, err
+	}
+	series, err := openDB(&options)
+	if err != nil {
+		return nil, err
+	}
+	series.parent, series.name = db, name
+	if err = series.openTiers(); err != nil {
+		return nil, err
+	}
+	if len(series.tiers) > 0 {
+		series.startRollup()
+	}
+	if db.series == nil {
+		db.series = make(map[string]*defaultDB)
+	}
+	db.series[name] = series
+	return series, nil
+}
+
+func (db *defaultDB) ListSeries() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(db.basePath, "series"))
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && seriesNamePattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// the named series opened by Series
+func (db *defaultDB) openedSeries() []*defaultDB {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	series := make([]*defaultDB, 0, len(db.series))
+	for _, s := range db.series {
+		series = append(series, s)
+	}
+	return series
+}
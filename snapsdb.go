@@ -8,9 +8,11 @@ import (
 	"reflect"
 
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // 初始化一个数据库
@@ -20,13 +22,65 @@ import (
 */
 func InitDB(opts ...Option) (SnapsDB, error) {
 	options := &dbOptions{
-		dataPath:      "./data",
-		retention:     TimestampOf7Day,
-		timekeyformat: "2006-01-02 15:04:05",
+		dataPath:        "./data",
+		retention:       TimestampOf7Day,
+		timekeyformat:   "2006-01-02 15:04:05",
+		resolution:      time.Second,
+		mmap:            true,
+		rollupTimelines: 3600,
+		codec:           ProtobufCodec,
 	}
 	for _, opt := range opts {
 		opt(options)
 	}
+	if err := checkOptions(options); err != nil {
+		return nil, err
+	}
+	db, err := openDB(options)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.openTiers(); err != nil {
+		return nil, err
+	}
+	if _, err = registerDB(db); err != nil {
+		return nil, err
+	}
+	if len(db.tiers) > 0 {
+		db.startRollup()
+	}
+	return db, nil
+}
+
+func checkOptions(options *dbOptions) error {
+	if options.codec == nil {
+		return errors.New("the database needs a codec")
+	}
+	if options.codec.ID() != CodecProtobuf {
+		// these options read the protobuf wire format of the objects
+		switch {
+		case options.index != "":
+			return errors.New("WithIndex and WithTagIndex need the protobuf codec")
+		case options.keyframes > 0:
+			return errors.New("WithDeltaEncoding needs the protobuf codec")
+		case len(options.tiers) > 0:
+			return errors.New("WithRollup needs the protobuf codec")
+		}
+	}
+	if err := checkResolution(options.resolution); err != nil {
+		return err
+	}
+	if err := checkCompression(options.compression); err != nil {
+		return err
+	}
+	if options.keyframes < 0 {
+		return fmt.Errorf("invalid keyframe interval %d", options.keyframes)
+	}
+	return nil
+}
+
+// create the database object of the data path
+func openDB(options *dbOptions) (*defaultDB, error) {
 	bpath, err := filepath.Abs(options.dataPath)
 	if err != nil {
 		return nil, err
@@ -35,59 +89,104 @@ func InitDB(opts ...Option) (SnapsDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db := defaultDB{
+	return &defaultDB{
 		basePath:      bpath,
 		retention:     options.retention,
 		opendFiles:    make(map[int64]StoreFile),
+		loadingFiles:  make(map[int64]*fileLoading),
 		timeKeyFormat: options.timekeyformat,
-	}
-	return registerDB(&db)
+		options:       options,
+		stats:         newDBStats(),
+	}, nil
 }
 
 type defaultDB struct {
 	basePath      string
 	opendFiles    map[int64]StoreFile
+	loadingFiles  map[int64]*fileLoading
 	retention     time.Duration
-	mutex         sync.Mutex
+	mutex         sync.RWMutex
 	timeKeyFormat string
+	options       *dbOptions
 	isDisposed    bool
+	tiers         []*rollupTier         // rollup tiers by resolution, see rollup.go
+	rollupQuit    chan struct{}         // stops the background rollup
+	rollupDone    chan struct{}         // closed when the background rollup stopped
+	stats         *dbStats              // shared with the rollup tiers, see stats.go
+	series        map[string]*defaultDB // opened named series, see series.go
+	parent        *defaultDB            // the database of a named series
+	name          string                // name of the series
 }
 
 func (db *defaultDB) StorageDirectory() string {
 	return db.basePath
 }
 
-func (db *defaultDB) QueryTimelineUnix(timeline int64, lp_out_slice interface{}) error {
-	return db.QueryTimeline(time.Unix(timeline, 0), lp_out_slice)
+func (db *defaultDB) QueryTimelineUnix(timeline int64, lp_out_slice interface{}, opts ...QueryOption) error {
+	return db.QueryTimeline(time.Unix(timeline, 0), lp_out_slice, opts...)
 }
 
-func (db *defaultDB) QueryTimeline(timeline time.Time, out_list interface{}) error {
+func (db *defaultDB) QueryTimeline(timeline time.Time, out_list interface{}, opts ...QueryOption) error {
+	if source, err := db.source(timeline, timeline, newQueryOptions(opts).resolution); err != nil || source != db {
+		if err != nil {
+			return err
+		}
+		return source.QueryTimeline(timeline, out_list, opts...)
+	}
+	defer db.stats.observeQuery(time.Now())
 	// 获取时间戳的时间基线，当天的0点时间戳，文件名
 	timebaseline := util.GetUnixOfDay(timeline)
+	slice_pointer, origin_slice, element_type, err := util.ParseSlicePointer(out_list, false)
+	if err == nil {
+		err = db.checkElement(*element_type)
+	}
+	if err != nil {
+		return err
+	}
+	filter, err := newQueryOptions(opts).filter(elementDescriptor(*element_type))
+	if err == nil {
+		err = db.checkSchema(timeline, timeline, elementDescriptor(*element_type))
+	}
+	if err != nil {
+		return err
+	}
 	storeFile, err := db.loadFile(timebaseline, false)
 	if err != nil && err != ErrorDBFileNotHit {
 		return err
 	}
 	if err == nil {
-		slice_pointer, origin_slice, element_type, err := util.ParseSlicePointer(out_list, false)
-		if err != nil {
-			return err
-		}
-		return storeFile.QueryTimeline(timeline.Unix(), slice_pointer, origin_slice, element_type)
+		return storeFile.QueryTimeline(timeline, slice_pointer, origin_slice, element_type, filter)
 	}
 	return nil
 }
 
-func (db *defaultDB) QueryBetweenUnix(begin int64, end int64, lp_out_map interface{}) error {
-	return db.QueryBetween(time.Unix(begin, 0), time.Unix(end, 0), lp_out_map)
+func (db *defaultDB) QueryBetweenUnix(begin int64, end int64, lp_out_map interface{}, opts ...QueryOption) error {
+	return db.QueryBetween(time.Unix(begin, 0), time.Unix(end, 0), lp_out_map, opts...)
 }
 
-func (db *defaultDB) QueryBetween(begin time.Time, end time.Time, out_map interface{}) error {
+func (db *defaultDB) QueryBetween(begin time.Time, end time.Time, out_map interface{}, opts ...QueryOption) error {
 	dis := end.Sub(begin)
 	if dis < 0 {
 		return errors.New("is not a valid time range")
 	}
+	if source, err := db.source(begin, end, newQueryOptions(opts).resolution); err != nil || source != db {
+		if err != nil {
+			return err
+		}
+		return source.QueryBetween(begin, end, out_map, opts...)
+	}
+	defer db.stats.observeQuery(time.Now())
 	map_pointer, map_type, key_type, slice_type, element_type, err := util.ParseMapPointer(out_map)
+	if err == nil {
+		err = db.checkElement(*element_type)
+	}
+	if err != nil {
+		return err
+	}
+	filter, err := newQueryOptions(opts).filter(elementDescriptor(*element_type))
+	if err == nil {
+		err = db.checkSchema(begin, end, elementDescriptor(*element_type))
+	}
 	if err != nil {
 		return err
 	}
@@ -105,7 +204,7 @@ func (db *defaultDB) QueryBetween(begin time.Time, end time.Time, out_map interf
 		if err != nil && err != ErrorDBFileNotHit {
 			return err
 		} else if err == nil {
-			err = storeFile.QueryBetween(begin.Unix(), end.Unix(), map_object, key_type, slice_type, element_type)
+			err = storeFile.QueryBetween(begin, end, map_object, key_type, slice_type, element_type, filter)
 			if err != nil {
 				return err
 			}
@@ -127,25 +226,109 @@ func (db *defaultDB) Write(timeline time.Time, data ...StoreData) error {
 	if err != nil {
 		return err
 	}
-	return storeFile.Write(timeline.Unix(), data...)
+	return storeFile.Write(timeline, data...)
 }
 
-func (db *defaultDB) loadFile(timebaseline int64, autoCreated bool) (StoreFile, error) {
-	if db.isDisposed {
-		return nil, errors.New("Database object has been destroyed")
+func (db *defaultDB) WriteObjectsUnix(timeline int64, objects ...interface{}) error {
+	return db.WriteObjects(time.Unix(timeline, 0), objects...)
+}
+
+// write one or more objects encoded by the codec of the database (see WithCodec) to the timeline
+func (db *defaultDB) WriteObjects(timeline time.Time, objects ...interface{}) error {
+	file, err := db.loadFile(util.GetUnixOfDay(timeline), true)
+	if err != nil {
+		return err
 	}
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	file := db.opendFiles[timebaseline]
-	if file == nil {
-		filepath := filepath.Join(db.basePath, fmt.Sprintf("%d.bin", timebaseline))
-		stroe, err := loadStoreFile(filepath, timebaseline, db.timeKeyFormat, autoCreated)
-		if err != nil {
-			return nil, err
+	return file.(*storeFile).write(timeline, objects)
+}
+
+// the codec of the objects of the database
+func (db *defaultDB) objectCodec() Codec {
+	return db.options.codec
+}
+
+// a storage file being opened, concurrent loads of the same file wait for done
+type fileLoading struct {
+	done chan struct{}
+	file StoreFile
+	err  error
+}
+
+// the opened storage file of the time base line, the file is opened without holding the database lock
+// so queries on opened files are not blocked by a slow open
+func (db *defaultDB) loadFile(timebaseline int64, autoCreated bool) (StoreFile, error) {
+	for {
+		db.mutex.RLock()
+		file, disposed := db.opendFiles[timebaseline], db.isDisposed
+		db.mutex.RUnlock()
+		if disposed {
+			return nil, errors.New("Database object has been destroyed")
+		}
+		if file != nil {
+			return file, nil
+		}
+		db.mutex.Lock()
+		if file = db.opendFiles[timebaseline]; file != nil {
+			db.mutex.Unlock()
+			return file, nil
+		}
+		loading := db.loadingFiles[timebaseline]
+		if loading != nil {
+			db.mutex.Unlock()
+			<-loading.done
+			if loading.file == nil && loading.err == nil || loading.err == ErrorDBFileNotHit && autoCreated {
+				// the slot was released by verify, or the other load did not create the file
+				continue
+			}
+			return loading.file, loading.err
+		}
+		loading = &fileLoading{done: make(chan struct{})}
+		db.loadingFiles[timebaseline] = loading
+		db.mutex.Unlock()
+
+		file, err := loadStoreFile(db.storageFileName(timebaseline), timebaseline, db.options, autoCreated)
+		db.mutex.Lock()
+		delete(db.loadingFiles, timebaseline)
+		if err == nil && db.isDisposed {
+			file.Close()
+			file, err = nil, errors.New("Database object has been destroyed")
 		}
-		db.opendFiles[timebaseline] = stroe
+		if err == nil {
+			file.(*storeFile).stats = db.stats
+			atomic.AddUint64(&db.stats.filesOpened, 1)
+			db.opendFiles[timebaseline] = file
+		}
+		loading.file, loading.err = file, err
+		db.mutex.Unlock()
+		close(loading.done)
+		return file, err
+	}
+}
+
+// the protobuf codec decodes protobuf messages, other codecs decode any element type
+func (db *defaultDB) checkElement(element_type reflect.Type) error {
+	if db.options.codec.ID() != CodecProtobuf {
+		return nil
+	}
+	return util.CheckMessageElement(element_type)
+}
+
+// message descriptor of a slice element type, a message struct or a pointer to it
+func elementDescriptor(element_type reflect.Type) protoreflect.MessageDescriptor {
+	if element_type.Kind() == reflect.Ptr {
+		element_type = element_type.Elem()
+	}
+	message, ok := reflect.New(element_type).Interface().(protoreflect.ProtoMessage)
+	if !ok {
+		// decoded by a codec other than protobuf
+		return nil
 	}
-	return db.opendFiles[timebaseline], nil
+	return message.ProtoReflect().Descriptor()
+}
+
+// storage file name of the time base line
+func (db *defaultDB) storageFileName(timebaseline int64) string {
+	return filepath.Join(db.basePath, fmt.Sprintf("%d.bin", timebaseline))
 }
 
 func (db *defaultDB) freeFile(timebaseline int64) {
@@ -164,22 +347,57 @@ func (db *defaultDB) DeleteStorageFileUnix(timeline int64) error {
 
 func (db *defaultDB) DeleteStorageFile(timeline time.Time) error {
 	timebaseline := util.GetUnixOfDay(timeline)
-	filepath := filepath.Join(db.basePath, fmt.Sprintf("%d.bin", timebaseline))
+	filepath := db.storageFileName(timebaseline)
 	if util.FileExist(filepath) {
 		db.freeFile(timebaseline)
+		os.Remove(walFileName(filepath))
+		os.Remove(indexFileName(filepath))
+		os.Remove(schemaFileName(filepath))
 		return os.Remove(filepath)
 	}
 	return errors.New("file not found")
 }
 
 func (db *defaultDB) Dispose() error {
+	db.dispose()
+	if db.parent != nil {
+		// a named series is not registered
+		db.parent.mutex.Lock()
+		if db.parent.series[db.name] == db {
+			delete(db.parent.series, db.name)
+		}
+		db.parent.mutex.Unlock()
+		return nil
+	}
+	return unRegisterDB(db)
+}
+
+// stop the background rollup and close the database, its rollup tiers and named series
+func (db *defaultDB) dispose() {
+	// the background rollup loads files, it is stopped before the lock is taken
+	if db.rollupQuit != nil {
+		close(db.rollupQuit)
+		<-db.rollupDone
+		db.rollupQuit = nil
+	}
+	for _, series := range db.openedSeries() {
+		series.dispose()
+	}
+	db.close()
+	for _, tier := range db.tiers {
+		tier.db.close()
+	}
+}
+
+// close every opened storage file, the database can not be used afterwards
+func (db *defaultDB) close() {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 	db.isDisposed = true
-	for k, _ := range db.opendFiles {
-		db.freeFile(k)
+	for k, file := range db.opendFiles {
+		file.Close()
+		delete(db.opendFiles, k)
 	}
-	return unRegisterDB(db)
 }
 
 func (db *defaultDB) IsExpired(timeline time.Time, now *time.Time) bool {
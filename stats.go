@@ -0,0 +1,190 @@
+package snapsdb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the query latency histogram buckets
+var queryLatencyBounds = []time.Duration{
+	time.Microsecond * 100,
+	time.Millisecond,
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+	time.Second * 10,
+}
+
+// counters of a database and its rollup tiers, updated atomically
+type dbStats struct {
+	writes             uint64
+	objectsWritten     uint64
+	bytesWritten       uint64
+	queries            uint64
+	queryNanos         uint64
+	queryBuckets       []uint64 // one more than queryLatencyBounds
+	filesOpened        uint64
+	retentionDeletions uint64
+	corruptRecords     uint64
+}
+
+func newDBStats() *dbStats {
+	return &dbStats{queryBuckets: make([]uint64, len(queryLatencyBounds)+1)}
+}
+
+// record the latency of a query begun at begin
+func (s *dbStats) observeQuery(begin time.Time) {
+	latency := time.Since(begin)
+	atomic.AddUint64(&s.queries, 1)
+	atomic.AddUint64(&s.queryNanos, uint64(latency))
+	bucket := sort.Search(len(queryLatencyBounds), func(i int) bool { return latency <= queryLatencyBounds[i] })
+	atomic.AddUint64(&s.queryBuckets[bucket], 1)
+}
+
+// a histogram of durations
+type Histogram struct {
+	Bounds []time.Duration // upper bounds of the buckets
+	Counts []uint64        // observations of every bucket, the last bucket is above every bound
+	Count  uint64
+	Sum    time.Duration
+}
+
+// a storage file of the database or a rollup tier
+type FileStats struct {
+	Path       string
+	Day        time.Time     // time base line of the file
+	Resolution time.Duration // resolution of the database or the rollup tier
+	Size       int64         // file size in bytes
+	Open       bool
+}
+
+// statistics of a database and its rollup tiers since it was initialized
+type Stats struct {
+	Path               string      // data path of the database
+	OpenFiles          int         // opened storage files
+	Files              []FileStats // storage files on disk in time order, the rollup tiers after the database
+	TotalBytes         int64       // size of every storage file
+	Writes             uint64      // Write calls that stored data
+	ObjectsWritten     uint64
+	BytesWritten       uint64 // bytes appended to the storage files
+	Queries            uint64
+	QueryLatency       Histogram
+	FilesOpened        uint64 // storage files opened or created
+	RetentionDeletions uint64 // storage files deleted after their retention
+	CorruptRecords     uint64 // corrupt records skipped by WithCorruptRecordHandler
+}
+
+// the statistics of the database, the storage files are listed from the data path
+/*
+	@example
+	stats, err := db.Stats()
+	fmt.Println(stats.OpenFiles, stats.TotalBytes, stats.QueryLatency.Count)
+*/
+func (db *defaultDB) Stats() (*Stats, error) {
+	s := db.stats
+	stats := &Stats{
+		Path:               db.basePath,
+		Files:              make([]FileStats, 0),
+		Writes:             atomic.LoadUint64(&s.writes),
+		ObjectsWritten:     atomic.LoadUint64(&s.objectsWritten),
+		BytesWritten:       atomic.LoadUint64(&s.bytesWritten),
+		Queries:            atomic.LoadUint64(&s.queries),
+		FilesOpened:        atomic.LoadUint64(&s.filesOpened),
+		RetentionDeletions: atomic.LoadUint64(&s.retentionDeletions),
+		CorruptRecords:     atomic.LoadUint64(&s.corruptRecords),
+	}
+	stats.QueryLatency = Histogram{
+		Bounds: append([]time.Duration{}, queryLatencyBounds...),
+		Counts: make([]uint64, len(s.queryBuckets)),
+		Sum:    time.Duration(atomic.LoadUint64(&s.queryNanos)),
+	}
+	for i := range s.queryBuckets {
+		stats.QueryLatency.Counts[i] = atomic.LoadUint64(&s.queryBuckets[i])
+		stats.QueryLatency.Count += stats.QueryLatency.Counts[i]
+	}
+	sources := []*defaultDB{db}
+	for _, tier := range db.tiers {
+		sources = append(sources, tier.db)
+	}
+	for _, source := range sources {
+		baselines, err := source.storageBaselines()
+		if err != nil {
+			return nil, err
+		}
+		source.mutex.RLock()
+		stats.OpenFiles += len(source.opendFiles)
+		open := make(map[int64]bool, len(source.opendFiles))
+		for baseline := range source.opendFiles {
+			open[baseline] = true
+		}
+		source.mutex.RUnlock()
+		for _, baseline := range baselines {
+			path := source.storageFileName(baseline)
+			info, err := os.Stat(path)
+			if err != nil {
+				// deleted after it was listed
+				continue
+			}
+			stats.Files = append(stats.Files, FileStats{Path: path, Day: time.Unix(baseline, 0), Resolution: source.options.resolution, Size: info.Size(), Open: open[baseline]})
+			stats.TotalBytes += info.Size()
+		}
+	}
+	return stats, nil
+}
+
+// write the statistics in the Prometheus text exposition format, the metrics are labeled with the data path
+func (stats *Stats) WritePrometheus(w io.Writer) error {
+	builder := &strings.Builder{}
+	path := fmt.Sprintf("path=%q", stats.Path)
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(builder, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %v\n", name, help, name, kind, name, path, value)
+	}
+	metric("snapsdb_open_files", "gauge", "Opened storage files.", stats.OpenFiles)
+	metric("snapsdb_storage_bytes", "gauge", "Size of every storage file in bytes.", stats.TotalBytes)
+	metric("snapsdb_writes_total", "counter", "Write calls that stored data.", stats.Writes)
+	metric("snapsdb_objects_written_total", "counter", "Objects written.", stats.ObjectsWritten)
+	metric("snapsdb_bytes_written_total", "counter", "Bytes appended to the storage files.", stats.BytesWritten)
+	metric("snapsdb_files_opened_total", "counter", "Storage files opened or created.", stats.FilesOpened)
+	metric("snapsdb_retention_deletions_total", "counter", "Storage files deleted after their retention.", stats.RetentionDeletions)
+	metric("snapsdb_corrupt_records_total", "counter", "Corrupt records skipped by queries.", stats.CorruptRecords)
+	builder.WriteString("# HELP snapsdb_file_bytes Size of a storage file in bytes.\n# TYPE snapsdb_file_bytes gauge\n")
+	for _, file := range stats.Files {
+		fmt.Fprintf(builder, "snapsdb_file_bytes{%s,file=%q,resolution=%q} %d\n", path, filepath.Base(file.Path), file.Resolution, file.Size)
+	}
+	builder.WriteString("# HELP snapsdb_query_duration_seconds Query latency.\n# TYPE snapsdb_query_duration_seconds histogram\n")
+	cumulative := uint64(0)
+	for i, bound := range stats.QueryLatency.Bounds {
+		cumulative += stats.QueryLatency.Counts[i]
+		fmt.Fprintf(builder, "snapsdb_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", path, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(builder, "snapsdb_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", path, stats.QueryLatency.Count)
+	fmt.Fprintf(builder, "snapsdb_query_duration_seconds_sum{%s} %g\n", path, stats.QueryLatency.Sum.Seconds())
+	fmt.Fprintf(builder, "snapsdb_query_duration_seconds_count{%s} %d\n", path, stats.QueryLatency.Count)
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// an http.Handler serving the statistics of the database in the Prometheus text format
+/*
+	@example
+	http.Handle("/metrics", snapsdb.PrometheusHandler(db))
+	http.ListenAndServe("127.0.0.1:9100", nil)
+*/
+func PrometheusHandler(db SnapsDB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := db.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats.WritePrometheus(w)
+	})
+}
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"math"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vblegend/snapsdb/util"
-	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
@@ -20,88 +25,205 @@ import (
 // =============================
 // 1.file header
 // offset 0 byte
-// size 16 byte
+// size 64 byte
 //
 // magic code  offset +0
 // timestamp   offset +8
+// resolution  offset +16    nanoseconds per timeline
+// flags       offset +24    feature flags (FlagChecksum, FlagCompression, FlagDelta)
+// version     offset +28    file format version
+// compression offset +32    compression of the records (FlagCompression)
+// codec       offset +36    codec id of the objects, see Codec
+// reserved    offset +40
 // =============================
 // 2.index table
-// offset 16 byte
-// size 691200 bytes (86400 * 8)
+// offset 64 byte
+// size (86400s / resolution) * 16 bytes
 //
-// First Record Address  offset (16 + index * 8) byte
-// Last  Record Address  offset (16 + index * 8 + 4) byte
+// First Record Address  offset (64 + index * 16) byte
+// Last  Record Address  offset (64 + index * 16 + 8) byte
 // =============================
 // 3.data block
-// offset (691200 + 16) byte
+// offset (64 + index table size) byte
+//
+// Timestamp			 size 8 byte     offset RecordAddress + 0    (timestamp / resolution)
+// Next Record Address   size 8 byte     offset RecordAddress + 8
+// data length  		 size 4 byte     offset RecordAddress + 16
+// binary data   		 size ... byte   offset RecordAddress + 20
+//
+// files with FlagChecksum insert a crc32c (castagnoli) of timestamp, data length and
+// binary data after the data length, the binary data starts at RecordAddress + 24
+//
+// files with FlagCompression store the objects of one write in one record, the binary data
+// is the compressed list of objects, each prefixed with its uvarint length.
 //
-// Timestamp			 size 8 byte     offset RecordAddress + 0
-// Next Record Address   size 4 byte     offset RecordAddress + 8
-// data length  		 size 4 byte     offset RecordAddress + 12
-// binary data   		 size ... byte   offset RecordAddress + 16
+// files with FlagDelta store the objects of one write in one frame record, see delta.go.
+//
+// format version 1 and 2 files use 4 byte record addresses (index table entry 8 bytes,
+// next record address 4 bytes) and can not grow beyond 4 GiB.
+// format version 1 files (magic code LegacyMagicCode) use a 16 byte header without
+// resolution, the index table always has 86400 one-second timelines, see MigrateFile.
 
 type storeFile struct {
-	TimelineBegin int64      // storage file time base line of begin
-	TimelineEnd   int64      // storage file time base line of end
-	file          *os.File   // storage file access object
-	mutex         sync.Mutex // access lock
+	TimelineBegin int64                          // storage file time base line of begin
+	TimelineEnd   int64                          // storage file time base line of end
+	resolution    time.Duration                  // duration of one timeline
+	timelines     int64                          // number of timelines in the index table
+	version       uint32                         // file format version
+	headerSize    int64                          // file header size
+	flags         uint32                         // file feature flags
+	compression   Compression                    // compression of the records
+	codecID       uint32                         // codec id of the file header
+	codec         Codec                          // codec of the objects, nil for files opened without a database
+	schema        protoreflect.MessageDescriptor // message type of the objects, nil when not recorded, see schema.go
+	schemaFile    string                         // schema file name of the storage file
+	addressSize   int64                          // record address size, 4 or 8 bytes
+	mateInfoSize  int64                          // index table entry size
+	recordSize    int64                          // record header size
+	size          int64                          // file size, the next record is appended here
+	file          *os.File                       // storage file access object
+	wal           *writeAheadLog                 // write ahead log of the storage file
+	mutex         sync.RWMutex                   // queries share the lock, writes hold it exclusively
 	timeKeyFormat string
+	onCorrupt     func(err *CorruptRecordError)
+	identity      protoreflect.Name // identity field of the objects in delta frames
+	keyframes     int               // a keyframe is written every keyframes frames
+	lastFrame     *deltaFrame       // the last written frame, the base of the next delta
+	frameCache    *deltaFrame       // the last reconstructed frame
+	cacheMutex    sync.Mutex        // frame cache lock, queries run concurrently
+	mmap          bool              // read through a memory mapping of the file
+	mapped        []byte            // memory mapping of the file, see mmap.go
+	indexField    string            // indexed field of the objects, see index.go
+	index         *secondaryIndex   // secondary index of the file, nil without indexField
+	stats         *dbStats          // counters of the database, nil for files opened without one
 }
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 // load file object from timebaseline
 // autoCreated = true  automatically created and initialized when file does not exist
 // autoCreated = fakse return error if file does not exist
-func loadStoreFile(filename string, timebaseline int64, timeKeyFormat string, autoCreated bool) (StoreFile, error) {
-	filev := storeFile{TimelineBegin: timebaseline, TimelineEnd: timebaseline + TimelineLengthOfDay, timeKeyFormat: timeKeyFormat}
+// the resolution option is only used when a new file is created, existing files keep the resolution of their header
+// an interrupted write found in the write ahead log is recovered before the file is returned
+func loadStoreFile(filename string, timebaseline int64, options *dbOptions, autoCreated bool) (StoreFile, error) {
+	filev := storeFile{TimelineBegin: timebaseline, TimelineEnd: timebaseline + TimelineLengthOfDay, timeKeyFormat: options.timekeyformat, onCorrupt: options.onCorrupt}
+	filev.identity = protoreflect.Name(options.identity)
+	filev.keyframes = options.keyframes
+	filev.mmap = options.mmap
+	filev.indexField = options.index
+	filev.codec = options.codec
 	var err error
 	if !util.FileExist(filename) {
 		if autoCreated {
-			err = filev.init(filename)
+			err = filev.init(filename, newFileHeader(timebaseline, options.resolution, options.compression, options.keyframes > 0, options.codecID()))
 		} else {
 			return nil, ErrorDBFileNotHit
 		}
 	} else {
-		err = filev.open(filename)
+		err = filev.open(filename, os.O_RDWR)
 	}
 	if err != nil {
 		return nil, err
 	}
-	// data, err := syscall.Mmap(int(filev.file.Fd()), 0, -1, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
-	// syscall.Ftruncate
-	// fmt.Println(data, err)
+	filev.wal, err = openWriteAheadLog(walFileName(filename), options.syncWrite)
+	if err == nil {
+		err = filev.wal.recover(filev.file)
+	}
+	if err == nil {
+		filev.size, err = filev.file.Seek(0, io.SeekEnd)
+	}
+	if err == nil && filev.codec != nil && filev.codecID != filev.codec.ID() {
+		err = fmt.Errorf("storage file %s uses codec %d, the database uses codec %d", filename, filev.codecID, filev.codec.ID())
+	}
+	if err == nil && filev.codec != nil {
+		filev.schemaFile = schemaFileName(filename)
+		var schemaErr error
+		// an unreadable schema does not fail the storage file, it is recorded again by the next write
+		if filev.schema, schemaErr = readSchema(filev.schemaFile); schemaErr != nil {
+			log.Printf("snapsdb: %v, the schema is recorded again on the next write", schemaErr)
+		}
+	}
+	if err == nil && filev.indexField != "" {
+		filev.index, err = openSecondaryIndex(indexFileName(filename))
+	}
+	if err != nil {
+		if filev.wal != nil {
+			filev.wal.file.Close()
+		}
+		filev.file.Close()
+		return nil, err
+	}
+	if filev.mmap {
+		filev.remap()
+	}
 	return &filev, nil
 }
 
-func (sf *storeFile) QueryBetween(begin int64, end int64, map_object reflect.Value, key_type *reflect.Kind, slice_type *reflect.Type, element_type *reflect.Type) error {
-	sf.Lock()
-	defer sf.Unlock()
-	hitFile := end >= sf.TimelineBegin && begin < sf.TimelineEnd
-	if !hitFile {
-		return errors.New("beyond the scope of the query")
+// open a storage file to read it only, the write ahead log is neither created nor replayed and the sidecars are not opened
+func openStoreFileReadOnly(filename string, timebaseline int64) (*storeFile, error) {
+	filev := &storeFile{TimelineBegin: timebaseline, TimelineEnd: timebaseline + TimelineLengthOfDay}
+	if err := filev.open(filename, os.O_RDONLY); err != nil {
+		return nil, err
+	}
+	size, err := filev.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		filev.file.Close()
+		return nil, err
 	}
-	beginTimeline := begin
-	if sf.TimelineBegin > beginTimeline {
-		beginTimeline = sf.TimelineBegin
+	filev.size = size
+	return filev, nil
+}
+
+// bring the file back to a committed state after a failed commit, a complete log is replayed and an
+// incomplete one discarded, the size is read from the file again. the metadata is read from the file on every write
+func (sf *storeFile) resync() {
+	if sf.wal.recover(sf.file) != nil {
+		// the log is kept and replayed when the file is opened again
+		return
 	}
-	endTimeline := end
-	if sf.TimelineEnd < endTimeline {
-		endTimeline = sf.TimelineEnd
+	if size, err := sf.file.Seek(0, io.SeekEnd); err == nil {
+		sf.size = size
 	}
-	length := int(endTimeline - beginTimeline)
-	for i := 0; i <= length; i++ {
-		timeline := beginTimeline + int64(i)
-		// 创建切片对象
-		slice := reflect.MakeSlice(*slice_type, 0, 16)
+	// the last frame may not be the last record anymore, the next write is a keyframe
+	sf.lastFrame = nil
+	if sf.mmap && sf.shouldRemap() {
+		sf.remap()
+	}
+}
+
+// write ahead log file name of the storage file
+func walFileName(filename string) string {
+	return strings.TrimSuffix(filename, ".bin") + ".wal"
+}
+
+func (sf *storeFile) QueryBetween(begin time.Time, end time.Time, map_object reflect.Value, key_type *reflect.Kind, slice_type *reflect.Type, element_type *reflect.Type, filter func(message StoreData) bool) error {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return ErrorFileClosed
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return errors.New("beyond the scope of the query")
+	}
+	for index := beginIndex; index <= endIndex; index++ {
+		timeline := sf.timelineOf(index)
+		// 获取 out_map key 类型
+		key := sf.GetReflectKey(timeline, *key_type)
+		// 同一个 key 可能对应多条时间线（时间精度小于 key 的精度），合并到同一个切片
+		slice := map_object.MapIndex(*key)
+		if !slice.IsValid() {
+			// 创建切片对象
+			slice = reflect.MakeSlice(*slice_type, 0, 16)
+		}
 		// 创建 切片指针
 		lpSlice := reflect.New(*slice_type)
 		// 指针指向 切片对象
 		lpSlice.Elem().Set(slice)
-		err := sf.queryByTimeline(timeline, &lpSlice, &slice, element_type)
+		err := sf.queryByIndex(index, &lpSlice, &slice, element_type, filter)
 		if err != nil && err != io.EOF {
 			return err
 		}
-		// 获取 out_map key 类型
-		key := sf.GetReflectKey(time.Unix(timeline, 0), *key_type)
 		// 添加至 Map内
 		map_object.SetMapIndex(*key, lpSlice.Elem())
 	}
@@ -121,142 +243,540 @@ func (sf *storeFile) GetReflectKey(timeline time.Time, key_type reflect.Kind) *r
 		value = reflect.ValueOf(uint32(timeline.Unix()))
 	case reflect.Int:
 		value = reflect.ValueOf(int(timeline.Unix()))
+	case reflect.Struct:
+		value = reflect.ValueOf(timeline)
 	}
 	return &value
 }
 
 // 查询某个时间线上的所有数据
-func (sf *storeFile) QueryTimeline(timeline int64, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type) error {
-	sf.Lock()
-	defer sf.Unlock()
-	return sf.queryByTimeline(timeline, slice_pointer, origin_slice, element_type)
+func (sf *storeFile) QueryTimeline(timeline time.Time, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type, filter func(message StoreData) bool) error {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return ErrorFileClosed
+	}
+	index, err := sf.indexOf(timeline)
+	if err != nil {
+		return err
+	}
+	return sf.queryByIndex(index, slice_pointer, origin_slice, element_type, filter)
 }
 
-// 查询某个时间线上所有的数据
-func (sf *storeFile) queryByTimeline(timeline int64, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type) error {
+// 查询某个时间线上所有的数据，filter 不为 nil 时只保留匹配的数据
+func (sf *storeFile) queryByIndex(index int64, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type, filter func(message StoreData) bool) error {
+	// elements are message structs or pointers to them
+	elementType := *element_type
+	pointer := elementType.Kind() == reflect.Ptr
+	if pointer {
+		elementType = elementType.Elem()
+	}
+	err := sf.walkTimeline(index, nil, func(header *recordHeader, data []byte) error {
+		refObject := reflect.New(elementType)
+		if err := sf.codec.Unmarshal(data, refObject.Interface()); err != nil {
+			return sf.corrupt(sf.corruptRecord(header, "unmarshal: "+err.Error()))
+		}
+		// filters are only compiled for protobuf messages
+		if filter != nil && !filter(refObject.Interface().(StoreData)) {
+			return nil
+		}
+		if pointer {
+			*origin_slice = reflect.Append(*origin_slice, refObject)
+		} else {
+			*origin_slice = reflect.Append(*origin_slice, refObject.Elem())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slice_pointer.Elem().Set(*origin_slice)
+	return nil
+}
+
+// walk the records of the timeline at index and call fn with the data of every stored object,
+// compressed records are unpacked into their objects.
+// a non-nil buffer is reused to read the records, the data passed to fn is only valid during the call
+func (sf *storeFile) walkTimeline(index int64, buffer *[]byte, fn func(header *recordHeader, data []byte) error) error {
 	// read metainfo
-	meta, err := sf.ReadMateInfo(timeline)
+	meta, err := sf.readMateInfo(index)
 	if err != nil {
 		return err
 	}
+	tick := sf.tickOf(index)
 	nextRecord := meta.TLFirst
 	for nextRecord != 0 {
-		buffer := make([]byte, 16)
-		dataPos := int64(nextRecord + 16)
-		readsize, err := sf.file.ReadAt(buffer, int64(nextRecord))
-		if err != nil || readsize != 16 {
+		header, err := sf.readRecordHeader(nextRecord)
+		if err != nil {
 			return err
 		}
-		_timeline := binary.LittleEndian.Uint32(buffer[:8])
-		if int64(_timeline) != timeline {
+		if header.Timeline != tick {
 			break
 		}
-		_nextdata := binary.LittleEndian.Uint32(buffer[8:12])
-		_datalen := binary.LittleEndian.Uint32(buffer[12:])
-		buffer = make([]byte, _datalen)
-		sf.file.ReadAt(buffer, dataPos)
-		//
-		refObject := reflect.New(*element_type)
-		object := refObject.Interface()
-		switch typed := object.(type) {
-		case protoreflect.ProtoMessage:
-			err := proto.Unmarshal(buffer, typed)
-			if err == nil {
-				*origin_slice = reflect.Append(*origin_slice, reflect.ValueOf(typed).Elem())
+		nextRecord = header.Next
+		// records are appended, a chain always points forward
+		if nextRecord != 0 && nextRecord <= header.Address {
+			if err = sf.corrupt(sf.corruptRecord(header, "next record points backward")); err != nil {
+				return err
+			}
+			nextRecord = 0
+		}
+		var data []byte
+		if buffer != nil {
+			if data, err = sf.readRecordDataTo(header, *buffer); err == nil {
+				*buffer = data
+			}
+		} else {
+			data, err = sf.readRecordData(header)
+		}
+		if err != nil {
+			if err = sf.corrupt(err); err != nil {
+				return err
+			}
+			continue
+		}
+		objects, err := sf.recordObjects(header, data)
+		if err != nil {
+			if err = sf.corrupt(err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, object := range objects {
+			if err = fn(header, object); err != nil {
+				return err
 			}
 		}
-		nextRecord = _nextdata
 	}
-	slice_pointer.Elem().Set(*origin_slice)
 	return nil
 }
 
-func (sf *storeFile) Write(timeline int64, data ...StoreData) error {
+// the stored objects of the record, compressed records and delta frames hold every object of one write
+func (sf *storeFile) recordObjects(header *recordHeader, data []byte) ([][]byte, error) {
+	if sf.flags&FlagDelta != 0 {
+		return sf.frameObjects(header, data)
+	}
+	if sf.compression == CompressionNone {
+		return [][]byte{data}, nil
+	}
+	objects := make([][]byte, 0, 16)
+	batch, err := sf.compression.decompress(data)
+	if err == nil {
+		err = decodeBatch(batch, func(item []byte) error {
+			objects = append(objects, item)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, sf.corruptRecord(header, "decompress: "+err.Error())
+	}
+	return objects, nil
+}
+
+func (sf *storeFile) Write(timeline time.Time, data ...StoreData) error {
+	objects := make([]interface{}, len(data))
+	for i, item := range data {
+		objects[i] = item
+	}
+	return sf.write(timeline, objects)
+}
+
+// append the objects encoded by the codec of the database to the timeline
+func (sf *storeFile) write(timeline time.Time, data []interface{}) error {
 	lenObject := len(data)
 	if lenObject == 0 {
 		return nil
 	}
 	sf.Lock()
 	defer sf.Unlock()
-	// read metainfo
-	meta, err := sf.ReadMateInfo(timeline)
+	if sf.file == nil {
+		return ErrorFileClosed
+	}
+	index, err := sf.indexOf(timeline)
 	if err != nil {
 		return err
 	}
-	// get file eof position
-	writePos, err := sf.file.Seek(0, 2)
+	// read metainfo
+	meta, err := sf.readMateInfo(index)
 	if err != nil {
 		return err
 	}
+	tick := sf.tickOf(index)
+	// file eof position
+	writePos := sf.size
 	// create batch buf
 	writeBuf := bytes.NewBuffer(make([]byte, 0))
 	var linkedOfLast int64 = 0
 	if meta.TLLast != 0 {
-		linkedOfLast = int64(meta.TLLast) + NextDataOffset
+		linkedOfLast = meta.TLLast + NextDataOffset
 	}
 	if meta.TLFirst == 0 {
-		meta.TLFirst = uint32(writePos)
+		meta.TLFirst = writePos
 	}
-	for i, item := range data {
-		position := writePos + int64(writeBuf.Len())
-		outdata, err := proto.Marshal(item)
-		if err != nil {
+	var indexNumber protowire.Number
+	if sf.index != nil {
+		message, ok := data[0].(StoreData)
+		if !ok {
+			return fmt.Errorf("%T is not a protobuf message, the index needs protobuf messages", data[0])
+		}
+		if indexNumber, err = indexNumberOf(message.ProtoReflect().Descriptor(), sf.indexField); err != nil {
+			return err
+		}
+	}
+	records, objects, frame, err := sf.encodeRecords(data)
+	if err != nil {
+		return err
+	}
+	if message, ok := data[0].(StoreData); ok {
+		descriptor := message.ProtoReflect().Descriptor()
+		for _, item := range data[1:] {
+			if other, ok := item.(StoreData); !ok || other.ProtoReflect().Descriptor().FullName() != descriptor.FullName() {
+				return fmt.Errorf("a write of %s holds a %T", descriptor.FullName(), item)
+			}
+		}
+		if err = sf.recordSchema(descriptor); err != nil {
 			return err
 		}
-		meta.TLLast = uint32(position)
-		var nextDataAddr uint32 = 0
-		if i < lenObject-1 {
-			nextDataAddr = uint32(position) + DataHeaderLen + uint32(len(outdata))
+	}
+	addresses := make([]int64, len(records))
+	for i, outdata := range records {
+		position := writePos + int64(writeBuf.Len())
+		addresses[i] = position
+		meta.TLLast = position
+		var nextDataAddr int64 = 0
+		if i < len(records)-1 {
+			nextDataAddr = position + sf.recordSize + int64(len(outdata))
 		}
-		binary.Write(writeBuf, binary.LittleEndian, timeline)             // timeline   8byte
-		binary.Write(writeBuf, binary.LittleEndian, nextDataAddr)         // nextdata	4byte
-		binary.Write(writeBuf, binary.LittleEndian, uint32(len(outdata))) // datalen    4byte
-		writeBuf.Write(outdata)                                           // data
+		sf.writeRecord(writeBuf, tick, nextDataAddr, outdata)
+	}
+	if sf.addressSize == 4 && writePos+int64(writeBuf.Len()) > math.MaxUint32 {
+		return ErrorFileTooLarge
 	}
-	// linked last record
+	// append records, link last record and update metadata in one commit
+	patches := []walPatch{{offset: writePos, data: writeBuf.Bytes()}}
 	if linkedOfLast > 0 {
-		nextRecordPosition := make([]byte, 4)
-		binary.LittleEndian.PutUint32(nextRecordPosition, uint32(writePos))
-		sf.file.WriteAt(nextRecordPosition, linkedOfLast)
-	}
-	// flush buf
-	sf.file.Seek(0, 2)
-	writeBuf.WriteTo(sf.file)
-	// update metadata
-	sf.writeMateInfo(timeline, meta)
+		nextRecordPosition := make([]byte, sf.addressSize)
+		sf.putAddress(nextRecordPosition, writePos)
+		patches = append(patches, walPatch{offset: linkedOfLast, data: nextRecordPosition})
+	}
+	patches = append(patches, sf.mateInfoPatch(index, meta))
+	if err = sf.wal.commit(sf.file, sf.size, patches); err != nil {
+		sf.resync()
+		return err
+	}
+	sf.size += int64(writeBuf.Len())
+	if sf.stats != nil {
+		atomic.AddUint64(&sf.stats.writes, 1)
+		atomic.AddUint64(&sf.stats.objectsWritten, uint64(len(data)))
+		atomic.AddUint64(&sf.stats.bytesWritten, uint64(writeBuf.Len()))
+	}
+	if frame != nil {
+		frame.address = writePos
+		sf.lastFrame = frame
+	}
+	if sf.index != nil {
+		// the write is committed, records the index misses are indexed before the next lookup
+		sf.index.add(sf, indexNumber, index, addresses, objects)
+	}
+	// queries never remap, the mapping only changes under the write lock
+	if sf.mmap && sf.shouldRemap() {
+		sf.remap()
+	}
 	return nil
 }
 
-func (sf *storeFile) ReadMateInfo(timeline int64) (*timelineMateInfo, error) {
-	if timeline < sf.TimelineBegin || timeline > sf.TimelineEnd {
+// encode the objects of one write into record data and the marshaled objects, delta files write one frame record
+// and compressed files one record holding the whole batch
+func (sf *storeFile) encodeRecords(data []interface{}) ([][]byte, [][]byte, *deltaFrame, error) {
+	if sf.flags&FlagDelta != 0 {
+		messages := make([]StoreData, len(data))
+		for i, item := range data {
+			message, ok := item.(StoreData)
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("%T is not a protobuf message, delta encoding needs protobuf messages", item)
+			}
+			messages[i] = message
+		}
+		outdata, frame, err := sf.encodeFrame(messages)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		objects := make([][]byte, len(frame.items))
+		for i, item := range frame.items {
+			objects[i] = item.data
+		}
+		return [][]byte{outdata}, objects, frame, nil
+	}
+	objects := make([][]byte, 0, len(data))
+	for _, item := range data {
+		outdata, err := sf.codec.Marshal(item)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		objects = append(objects, outdata)
+	}
+	if sf.compression != CompressionNone {
+		outdata, err := sf.compression.compress(encodeBatch(objects))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return [][]byte{outdata}, objects, nil, nil
+	}
+	return objects, objects, nil, nil
+}
+
+func (sf *storeFile) ReadMateInfo(timeline time.Time) (*timelineMateInfo, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return nil, ErrorFileClosed
+	}
+	index, err := sf.indexOf(timeline)
+	if err != nil {
+		return nil, err
+	}
+	return sf.readMateInfo(index)
+}
+
+func (sf *storeFile) readMateInfo(index int64) (*timelineMateInfo, error) {
+	if index < 0 || index >= sf.timelines {
+		return nil, errors.New("beyond the scope of the query.")
+	}
+	buffer := make([]byte, sf.mateInfoSize)
+	offset := sf.mateInfoSize*index + sf.headerSize
+	sf.readAt(buffer, offset)
+	return sf.decodeMateInfo(buffer), nil
+}
+
+// read the meta information of the timelines from beginIndex to endIndex in one piece
+func (sf *storeFile) readIndexTable(beginIndex int64, endIndex int64) ([]timelineMateInfo, error) {
+	if beginIndex < 0 || endIndex >= sf.timelines || endIndex < beginIndex {
 		return nil, errors.New("beyond the scope of the query.")
 	}
-	buffer := make([]byte, 8)
-	disc := timeline - sf.TimelineBegin
-	offset := MateInfoSize*disc + FileHeaderOffset
-	sf.file.ReadAt(buffer, offset)
-	first := binary.LittleEndian.Uint32(buffer[:4])
-	last := binary.LittleEndian.Uint32(buffer[4:])
-	return &timelineMateInfo{TLFirst: first, TLLast: last}, nil
-}
-
-func (sf *storeFile) writeMateInfo(timeline int64, info *timelineMateInfo) error {
-	if timeline < sf.TimelineBegin || timeline > sf.TimelineEnd {
-		return errors.New("超出范围。")
-	}
-	buffer := make([]byte, 8)
-	binary.LittleEndian.PutUint32(buffer[:4], info.TLFirst)
-	binary.LittleEndian.PutUint32(buffer[4:], info.TLLast)
-	disc := timeline - sf.TimelineBegin
-	offset := MateInfoSize*disc + FileHeaderOffset
-	sf.file.WriteAt(buffer, offset)
+	buffer := make([]byte, (endIndex-beginIndex+1)*sf.mateInfoSize)
+	if _, err := sf.readAt(buffer, sf.mateInfoSize*beginIndex+sf.headerSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	table := make([]timelineMateInfo, endIndex-beginIndex+1)
+	for i := range table {
+		table[i] = *sf.decodeMateInfo(buffer[int64(i)*sf.mateInfoSize:])
+	}
+	return table, nil
+}
+
+// the number of timelines of the index table read at once by walkIndexTable
+const indexTableChunk = int64(4096)
+
+// visit the meta information of the timelines from beginIndex to endIndex, backwards when reverse is set.
+// the table is read in chunks of indexTableChunk timelines, visit returns false to stop
+func (sf *storeFile) walkIndexTable(beginIndex int64, endIndex int64, reverse bool, visit func(index int64, meta *timelineMateInfo) bool) error {
+	for first := beginIndex; first <= endIndex; first += indexTableChunk {
+		chunkBegin, chunkEnd := first, first+indexTableChunk-1
+		if reverse {
+			chunkBegin, chunkEnd = endIndex-(first-beginIndex)-indexTableChunk+1, endIndex-(first-beginIndex)
+		}
+		if chunkBegin < beginIndex {
+			chunkBegin = beginIndex
+		}
+		if chunkEnd > endIndex {
+			chunkEnd = endIndex
+		}
+		table, err := sf.readIndexTable(chunkBegin, chunkEnd)
+		if err != nil {
+			return err
+		}
+		for i := range table {
+			offset := int64(i)
+			if reverse {
+				offset = int64(len(table) - 1 - i)
+			}
+			if !visit(chunkBegin+offset, &table[offset]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// the write of timeline meta information
+func (sf *storeFile) mateInfoPatch(index int64, info *timelineMateInfo) walPatch {
+	buffer := make([]byte, sf.mateInfoSize)
+	sf.encodeMateInfo(buffer, info)
+	offset := sf.mateInfoSize*index + sf.headerSize
+	return walPatch{offset: offset, data: buffer}
+}
+
+func (sf *storeFile) decodeMateInfo(buffer []byte) *timelineMateInfo {
+	return &timelineMateInfo{TLFirst: sf.getAddress(buffer), TLLast: sf.getAddress(buffer[sf.addressSize:])}
+}
+
+func (sf *storeFile) encodeMateInfo(buffer []byte, info *timelineMateInfo) {
+	sf.putAddress(buffer, info.TLFirst)
+	sf.putAddress(buffer[sf.addressSize:], info.TLLast)
+}
+
+// read a record address of the file address size
+func (sf *storeFile) getAddress(buffer []byte) int64 {
+	if sf.addressSize == 4 {
+		return int64(binary.LittleEndian.Uint32(buffer))
+	}
+	return int64(binary.LittleEndian.Uint64(buffer))
+}
+
+// write a record address of the file address size
+func (sf *storeFile) putAddress(buffer []byte, address int64) {
+	if sf.addressSize == 4 {
+		binary.LittleEndian.PutUint32(buffer, uint32(address))
+	} else {
+		binary.LittleEndian.PutUint64(buffer, uint64(address))
+	}
+}
+
+// encode a record to the buffer
+func (sf *storeFile) writeRecord(buf *bytes.Buffer, tick int64, next int64, data []byte) {
+	address := make([]byte, sf.addressSize)
+	sf.putAddress(address, next)
+	binary.Write(buf, binary.LittleEndian, tick)              // timeline   8byte
+	buf.Write(address)                                        // nextdata	4/8byte
+	binary.Write(buf, binary.LittleEndian, uint32(len(data))) // datalen    4byte
+	if sf.flags&FlagChecksum != 0 {
+		binary.Write(buf, binary.LittleEndian, recordChecksum(tick, data)) // checksum   4byte
+	}
+	buf.Write(data) // data
+}
+
+// read the header of the record at address
+func (sf *storeFile) readRecordHeader(address int64) (*recordHeader, error) {
+	buffer := make([]byte, sf.recordSize)
+	if _, err := sf.readAt(buffer, address); err != nil {
+		return nil, err
+	}
+	lengthOffset := 8 + sf.addressSize
+	header := &recordHeader{
+		Address:  address,
+		Timeline: int64(binary.LittleEndian.Uint64(buffer[:8])),
+		Next:     sf.getAddress(buffer[8:]),
+		Length:   binary.LittleEndian.Uint32(buffer[lengthOffset:]),
+		Size:     sf.recordSize,
+	}
+	if sf.flags&FlagChecksum != 0 {
+		header.Checksum = binary.LittleEndian.Uint32(buffer[lengthOffset+4:])
+	}
+	return header, nil
+}
+
+// read the data of the record and check it against the checksum of the record header
+func (sf *storeFile) readRecordData(header *recordHeader) ([]byte, error) {
+	return sf.readRecordDataTo(header, nil)
+}
+
+// read the data of the record into buffer, the buffer is grown when it is too small
+func (sf *storeFile) readRecordDataTo(header *recordHeader, buffer []byte) ([]byte, error) {
+	// a damaged length must not allocate before the checksum is checked
+	if header.dataAddress()+int64(header.Length) > sf.size {
+		return nil, sf.corruptRecord(header, "data exceeds the end of the file")
+	}
+	if uint32(cap(buffer)) < header.Length {
+		buffer = make([]byte, header.Length)
+	}
+	buffer = buffer[:header.Length]
+	readsize, err := sf.readAt(buffer, header.dataAddress())
+	if readsize != len(buffer) {
+		if err == io.EOF {
+			return nil, sf.corruptRecord(header, "data exceeds the end of the file")
+		}
+		return nil, err
+	}
+	if sf.flags&FlagChecksum != 0 && recordChecksum(header.Timeline, buffer) != header.Checksum {
+		return nil, sf.corruptRecord(header, "checksum mismatch")
+	}
+	return buffer, nil
+}
+
+func (sf *storeFile) corruptRecord(header *recordHeader, reason string) *CorruptRecordError {
+	index := header.Timeline - sf.tickOf(0)
+	return &CorruptRecordError{File: sf.file.Name(), Timeline: sf.timelineOf(index), Address: header.Address, Reason: reason}
+}
+
+// hand a corrupt record to the handler, the error is returned when there is no handler or it is not a corrupt record
+func (sf *storeFile) corrupt(err error) error {
+	corruptErr, ok := err.(*CorruptRecordError)
+	if !ok || sf.onCorrupt == nil {
+		return err
+	}
+	if sf.stats != nil {
+		atomic.AddUint64(&sf.stats.corruptRecords, 1)
+	}
+	sf.onCorrupt(corruptErr)
 	return nil
 }
 
-func (sf *storeFile) open(filepath string) error {
+// crc32c of the record timeline, data length and data
+func recordChecksum(tick int64, data []byte) uint32 {
+	buffer := make([]byte, 12)
+	binary.LittleEndian.PutUint64(buffer[:8], uint64(tick))
+	binary.LittleEndian.PutUint32(buffer[8:], uint32(len(data)))
+	checksum := crc32.Update(0, crc32cTable, buffer)
+	return crc32.Update(checksum, crc32cTable, data)
+}
+
+// offset of the data block, the first record is written here
+func (sf *storeFile) dataOffset() int64 {
+	return sf.headerSize + sf.timelines*sf.mateInfoSize
+}
+
+// index of the timeline in the index table
+func (sf *storeFile) indexOf(timeline time.Time) (int64, error) {
+	offset := timeline.UnixNano() - sf.TimelineBegin*int64(time.Second)
+	if offset < 0 || offset >= sf.timelines*int64(sf.resolution) {
+		return 0, errors.New("beyond the scope of the query.")
+	}
+	return offset / int64(sf.resolution), nil
+}
+
+// begin time of the timeline at index
+func (sf *storeFile) timelineOf(index int64) time.Time {
+	return time.Unix(sf.TimelineBegin, index*int64(sf.resolution))
+}
+
+// timestamp stored in the record header, in units of resolution
+func (sf *storeFile) tickOf(index int64) int64 {
+	return sf.TimelineBegin*int64(time.Second)/int64(sf.resolution) + index
+}
+
+// clamp the time range to the index range of this file, ok is false when the range misses the file
+func (sf *storeFile) clampIndex(begin time.Time, end time.Time) (int64, int64, bool) {
+	fileBegin := time.Unix(sf.TimelineBegin, 0)
+	fileEnd := time.Unix(sf.TimelineEnd, 0)
+	if end.Before(fileBegin) || !begin.Before(fileEnd) {
+		return 0, 0, false
+	}
+	beginIndex := int64(0)
+	if begin.After(fileBegin) {
+		beginIndex, _ = sf.indexOf(begin)
+	}
+	endIndex := sf.timelines - 1
+	if end.Before(fileEnd) {
+		endIndex, _ = sf.indexOf(end)
+	}
+	return beginIndex, endIndex, true
+}
+
+func (sf *storeFile) open(filepath string, flag int) error {
 	var err error = nil
-	sf.file, err = os.OpenFile(filepath, os.O_RDWR, 0777)
-	return err
+	sf.file, err = os.OpenFile(filepath, flag, 0777)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, FileHeaderSize)
+	readsize, _ := sf.file.ReadAt(buffer, 0)
+	header, err := decodeFileHeader(buffer[:readsize])
+	if err != nil {
+		sf.file.Close()
+		return err
+	}
+	sf.applyHeader(header)
+	return nil
 }
 
 func (sf *storeFile) Lock() {
@@ -267,26 +787,63 @@ func (sf *storeFile) Unlock() {
 	sf.mutex.Unlock()
 }
 
+func (sf *storeFile) RLock() {
+	sf.mutex.RLock()
+}
+
+func (sf *storeFile) RUnlock() {
+	sf.mutex.RUnlock()
+}
+
 func (sf *storeFile) Close() {
 	sf.Lock()
 	defer sf.Unlock()
+	if sf.file == nil {
+		return
+	}
+	sf.unmap()
+	if sf.wal != nil {
+		sf.wal.close()
+	}
+	if sf.index != nil {
+		sf.index.close()
+	}
 	sf.file.Close()
 	sf.file = nil
 }
-func (sf *storeFile) init(filepath string) error {
-	file, err := os.Create(filepath)
+
+// create the file under a temporary name and rename it when initialized,
+// so a crash never leaves a file with a partial header behind
+func (sf *storeFile) init(filepath string, header *fileHeader) error {
+	tempfile := filepath + ".tmp"
+	file, err := os.Create(tempfile)
 	if err != nil {
 		return err
 	}
-	binary.Write(file, binary.LittleEndian, uint64(7089841687217925715)) // file flags    offset + 0
-	binary.Write(file, binary.LittleEndian, sf.TimelineBegin)            // timebaseline  offset + 8
-	for i := int64(0); i < TimelineLengthOfDay; i++ {                    //  			  offset + (16 + timeline * UnitSize) UnitSize = 8
-		binary.Write(file, binary.LittleEndian, uint32(0)) // TLFirst	  				  offset + 0
-		binary.Write(file, binary.LittleEndian, uint32(0)) // TLLast	  				  offset + 4
+	sf.applyHeader(header)
+	if _, err = file.Write(header.encode()); err == nil {
+		// the index table is zero filled, leave it sparse
+		err = file.Truncate(sf.dataOffset())
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempfile, filepath)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempfile)
+		return err
 	}
 	sf.file = file
-	return err
+	return nil
 }
+
 func (sf *storeFile) TimeBaseline() int64 {
 	return sf.TimelineBegin
 }
+
+func (sf *storeFile) Resolution() time.Duration {
+	return sf.resolution
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -50,7 +51,7 @@ func unRegisterDB(db SnapsDB) error {
 
 func monitorRetention() {
 	ticker := time.NewTicker(time.Second * 60 * 5)
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGQUIT)
 	for {
 		select {
@@ -72,7 +73,12 @@ func systemcheckcall() {
 }
 
 func checkDBStorage(db SnapsDB, now time.Time) {
-	filepath.Walk(db.StorageDirectory(), func(path string, info os.FileInfo, err error) error {
+	root := db.StorageDirectory()
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != root {
+			// rollup tiers and named series keep their own retention
+			return filepath.SkipDir
+		}
 		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".bin") {
 			return nil
 		}
@@ -81,11 +87,21 @@ func checkDBStorage(db SnapsDB, now time.Time) {
 			num, err := strconv.ParseInt(filetimestamp, 0, 64)
 			if err == nil {
 				timestamp := time.Unix(num, 0)
-				if db.IsExpired(timestamp, &now) {
-					db.DeleteStorageFile(timestamp)
+				if db.IsExpired(timestamp, &now) && db.DeleteStorageFile(timestamp) == nil {
+					if d, ok := db.(*defaultDB); ok {
+						atomic.AddUint64(&d.stats.retentionDeletions, 1)
+					}
 				}
 			}
 		}
 		return nil
 	})
+	if d, ok := db.(*defaultDB); ok {
+		for _, tier := range d.tiers {
+			checkDBStorage(tier.db, now)
+		}
+		for _, series := range d.openedSeries() {
+			checkDBStorage(series, now)
+		}
+	}
 }
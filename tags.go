@@ -0,0 +1,286 @@
+package snapsdb
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// tag index
+// =============================
+// with WithTagIndex the secondary index of every storage file (see index.go) maps the tags of the stored
+// data points to their records, the term of a tag is "<key>\x00<value>". the field number of the index
+// file is tagIndexNumber, which is not a valid protobuf field number.
+//
+// tags are matched by their string form: strings as they are, time.Time in RFC 3339 (UTC) and every
+// other value formatted by fmt.Sprint, so the tag 1 matches "1".
+// =============================
+
+// the index field of WithTagIndex, not a valid protobuf field name
+const tagIndexField = "#tags"
+
+// the field number of a tag index file, above the largest protobuf field number
+const tagIndexNumber = protowire.Number(math.MaxInt32)
+
+// a condition on one tag of the data points, see WithTag, WithTagIn and WithTagRegex
+type tagMatcher struct {
+	key    string
+	values []string       // the tag has one of the values
+	regex  *regexp.Regexp // the tag matches the expression when set
+	err    error          // the expression does not compile
+}
+
+func (m *tagMatcher) match(value string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(value)
+	}
+	for _, expected := range m.values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// the point has the tag and it matches
+func (m *tagMatcher) matchPoint(point *DataPoint) bool {
+	value, ok := point.Tags[m.key]
+	return ok && m.match(tagString(value))
+}
+
+// only data points whose tag key has the value are returned by QueryPoints, conditions of more than one tag are all met
+func WithTag(key string, value interface{}) QueryOption {
+	return WithTagIn(key, value)
+}
+
+// only data points whose tag key has one of the values are returned by QueryPoints
+func WithTagIn(key string, values ...interface{}) QueryOption {
+	matcher := &tagMatcher{key: key, values: make([]string, len(values))}
+	for i, value := range values {
+		matcher.values[i] = tagString(value)
+	}
+	return func(o *queryOptions) {
+		o.tags = append(o.tags, matcher)
+	}
+}
+
+// only data points whose tag key matches the regular expression (the whole value, e.g. "web-.*") are returned by QueryPoints
+func WithTagRegex(key string, expression string) QueryOption {
+	matcher := &tagMatcher{key: key}
+	matcher.regex, matcher.err = regexp.Compile("^(?:" + expression + ")$")
+	return func(o *queryOptions) {
+		o.tags = append(o.tags, matcher)
+	}
+}
+
+// the string form of a tag value
+func tagString(value interface{}) string {
+	if v := util.Indirect(reflect.ValueOf(value)); v.IsValid() {
+		value = v.Interface()
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// the term of a tag in the index
+func tagTerm(key string, value string) string {
+	return key + "\x00" + value
+}
+
+// the tag terms of a marshaled data point record, none when the record is not a data point
+func pointTagTerms(data []byte) [][]byte {
+	point, err := decodePoint(indexTerm(data, 1))
+	if err != nil {
+		return nil
+	}
+	terms := make([][]byte, 0, len(point.Tags))
+	for key, value := range point.Tags {
+		terms = append(terms, []byte(tagTerm(key, tagString(value))))
+	}
+	return terms
+}
+
+// walk the data points matching every tag condition between begin and end in time order, the records are found
+// through the tag index of every file. without a tag index every record is walked and decode has to check the tags
+func (db *defaultDB) walkTags(begin time.Time, end time.Time, matchers []*tagMatcher, visit func(timeline time.Time) bool, decode func(data []byte) error) error {
+	if db.options.index != tagIndexField {
+		return db.walkRange(begin, end, false, visit, decode)
+	}
+	defer db.stats.observeQuery(time.Now())
+	if end.Before(begin) {
+		return fmt.Errorf("is not a valid time range")
+	}
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		next, err := file.(*storeFile).walkTags(begin, end, matchers, visit, decode)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk the objects of the file whose tags match every condition, only the records holding them are read
+func (sf *storeFile) walkTags(begin time.Time, end time.Time, matchers []*tagMatcher, visit func(timeline time.Time) bool, decode func(data []byte) error) (bool, error) {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return false, ErrorFileClosed
+	}
+	if sf.index == nil {
+		return false, ErrorNoIndex
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return true, nil
+	}
+	var entries []indexEntry
+	for i, matcher := range matchers {
+		terms := make([]string, 0, len(matcher.values))
+		for _, value := range matcher.values {
+			terms = append(terms, tagTerm(matcher.key, value))
+		}
+		if matcher.regex != nil {
+			prefix := tagTerm(matcher.key, "")
+			var err error
+			if terms, err = sf.index.matchTerms(sf, tagIndexNumber, func(term string) bool {
+				return strings.HasPrefix(term, prefix) && matcher.regex.MatchString(term[len(prefix):])
+			}); err != nil {
+				return false, err
+			}
+		}
+		matched, err := sf.index.lookup(sf, tagIndexNumber, terms, beginIndex, endIndex)
+		if err != nil {
+			return false, err
+		}
+		if i > 0 {
+			matched = intersectEntries(entries, matched)
+		}
+		if entries = matched; len(entries) == 0 {
+			return true, nil
+		}
+	}
+	// the caller checks the tags of the decoded points
+	return sf.walkEntries(entries, func(object []byte) bool { return true }, visit, decode)
+}
+
+// the entries of both sorted lists
+func intersectEntries(a []indexEntry, b []indexEntry) []indexEntry {
+	seen := make(map[indexEntry]bool, len(a))
+	for _, entry := range a {
+		seen[entry] = true
+	}
+	entries := make([]indexEntry, 0)
+	for _, entry := range b {
+		if seen[entry] {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// the tag keys of the data points between begin and end in ascending order, read from the tag index
+/*
+	@example
+	keys, err := db.TagKeys(beginTimestamp, endTimestamp)
+*/
+func (db *defaultDB) TagKeys(begin time.Time, end time.Time) ([]string, error) {
+	return db.tagTerms(begin, end, func(term string) (string, bool) {
+		return term[:strings.IndexByte(term, 0)], true
+	})
+}
+
+// the values of the tag key of the data points between begin and end in ascending order, read from the tag index
+/*
+	@example
+	hosts, err := db.TagValues(beginTimestamp, endTimestamp, "host")
+*/
+func (db *defaultDB) TagValues(begin time.Time, end time.Time, key string) ([]string, error) {
+	prefix := tagTerm(key, "")
+	return db.tagTerms(begin, end, func(term string) (string, bool) {
+		return term[len(prefix):], strings.HasPrefix(term, prefix)
+	})
+}
+
+// the distinct results of name for the tag terms with entries between begin and end
+func (db *defaultDB) tagTerms(begin time.Time, end time.Time, name func(term string) (string, bool)) ([]string, error) {
+	if db.options.index != tagIndexField {
+		return nil, ErrorNoIndex
+	}
+	if end.Before(begin) {
+		return nil, fmt.Errorf("is not a valid time range")
+	}
+	names := make(map[string]bool)
+	for timebasetime := util.GetTimeOfDay(begin); !timebasetime.After(end); timebasetime = timebasetime.Add(TimestampOf1Day) {
+		file, err := db.loadFile(timebasetime.Unix(), false)
+		if err == ErrorDBFileNotHit {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = file.(*storeFile).tagTerms(begin, end, name, names); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]string, 0, len(names))
+	for n := range names {
+		result = append(result, n)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// add the names of the tag terms with entries between begin and end
+func (sf *storeFile) tagTerms(begin time.Time, end time.Time, name func(term string) (string, bool), names map[string]bool) error {
+	sf.RLock()
+	defer sf.RUnlock()
+	if sf.file == nil {
+		return ErrorFileClosed
+	}
+	if sf.index == nil {
+		return ErrorNoIndex
+	}
+	beginIndex, endIndex, ok := sf.clampIndex(begin, end)
+	if !ok {
+		return nil
+	}
+	terms, err := sf.index.matchTerms(sf, tagIndexNumber, func(term string) bool {
+		n, ok := name(term)
+		return ok && !names[n]
+	})
+	if err != nil {
+		return err
+	}
+	for _, term := range terms {
+		if n, _ := name(term); !names[n] {
+			// only the blocks up to the first entry between the indexes are read
+			found, err := sf.index.contains(sf, tagIndexNumber, term, beginIndex, endIndex)
+			if err != nil {
+				return err
+			}
+			if found {
+				names[n] = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 按时间段聚合数据
+func TestAggregate(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	// 3 分钟，每秒 3 个进程
+	for i := 0; i < 180; i++ {
+		array := make([]snapsdb.StoreData, 0)
+		for pid := 1; pid <= 3; pid++ {
+			array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("proc-%d", pid), Cpu: float32(i % 60 * pid), Res: uint64(pid) << 20})
+		}
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := base.Add(time.Hour)
+	buckets, err := db.Aggregate(base, end, time.Minute, &types.ProcessInfo{}, "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("%d buckets, expected 3", len(buckets))
+	}
+	for i, bucket := range buckets {
+		aggregate := bucket.Groups[""]
+		if !bucket.Begin.Equal(base.Add(time.Minute*time.Duration(i))) || aggregate == nil {
+			t.Fatalf("unexpected bucket %v", bucket)
+		}
+		// sum of 0..59 is 1770, pid 1..3 multiplies it by 6
+		if aggregate.Count != 180 || aggregate.Sum != 1770*6 || aggregate.Min != 0 || aggregate.Max != 177 || aggregate.Avg() != 59 {
+			t.Fatalf("unexpected aggregate %+v", aggregate)
+		}
+	}
+	buckets, err = db.Aggregate(base, end, time.Minute*2, &types.ProcessInfo{}, "res", snapsdb.WithGroupBy("name"), snapsdb.WithFieldFilter("pid != 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || len(buckets[0].Groups) != 2 || buckets[1].Groups["proc-3"].Count != 60 {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+	if aggregate := buckets[0].Groups["proc-3"]; aggregate.Count != 120 || aggregate.Min != 3<<20 || aggregate.Avg() != 3<<20 {
+		t.Fatalf("unexpected aggregate %+v", aggregate)
+	}
+	// 起始时间不在整分钟上
+	buckets, err = db.Aggregate(base.Add(time.Second*30), end, time.Minute, &types.ProcessInfo{}, "pid", snapsdb.WithFieldFilter("pid == 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 || buckets[0].Groups[""].Count != 60 || buckets[2].Groups[""].Count != 30 {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+	for _, field := range []string{"name", "unknown"} {
+		if _, err = db.Aggregate(base, end, time.Minute, &types.ProcessInfo{}, field); err == nil {
+			t.Fatalf("aggregation of field %s accepted", field)
+		}
+	}
+	if _, err = db.Aggregate(base, end, 0, &types.ProcessInfo{}, "cpu"); err == nil {
+		t.Fatal("empty bucket accepted")
+	}
+}
+
+// 测试 配置降采样层级后聚合仍读取原始数据
+func TestAggregateRawWithRollup(t *testing.T) {
+	db, err := snapsdb.InitDB(
+		snapsdb.WithDataPath(t.TempDir()),
+		snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+		snapsdb.WithRollup(snapsdb.RollupTier{Resolution: time.Minute, Retention: snapsdb.TimestampOf100Year, Message: &types.ProcessInfo{}, Reducer: snapsdb.FieldReducer("pid", snapsdb.RollupAvg)}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for i := 0; i < 180; i++ {
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: 1, Cpu: float32(i % 60)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Rollup(); err != nil {
+		t.Fatal(err)
+	}
+	// 超过 3600 个时间线的区间
+	end := base.Add(time.Hour * 2)
+	buckets, err := db.Aggregate(base, end, time.Hour, &types.ProcessInfo{}, "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("%d buckets, expected 1", len(buckets))
+	}
+	if aggregate := buckets[0].Groups[""]; aggregate.Count != 180 || aggregate.Max != 59 {
+		t.Fatalf("unexpected raw aggregate %+v", aggregate)
+	}
+	buckets, err = db.Aggregate(base, end, time.Hour, &types.ProcessInfo{}, "cpu", snapsdb.WithResolution(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggregate := buckets[0].Groups[""]; aggregate.Count != 3 || aggregate.Max != 29.5 {
+		t.Fatalf("unexpected minute aggregate %+v", aggregate)
+	}
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 查询某个时间点之前最近的快照
+func TestQueryAsOf(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	midnight := time.Date(2022, 9, 22, 0, 0, 0, 0, time.Local)
+	snapshots := []time.Time{midnight.Add(-time.Second * 10), base, base.Add(time.Second * 10)}
+	for i, timeline := range snapshots {
+		if err = db.Write(timeline, &types.ProcessInfo{Pid: int32(i + 1)}, &types.ProcessInfo{Pid: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		timeline time.Time
+		lookback time.Duration
+		expected int // index of the snapshot, -1 for none
+	}{
+		{base.Add(time.Second * 5), time.Minute, 1},
+		{base, time.Minute, 1},
+		{base.Add(time.Second * 20), time.Second * 5, -1},
+		{midnight.Add(time.Second * 30), time.Hour, 0},
+		{midnight.Add(time.Second * 30), time.Second * 30, -1},
+		{base.Add(snapsdb.TimestampOf7Day), 0, 2},
+		// 索引表按 4096 个时间线分块读取，快照在块的两侧
+		{base.Add(time.Second * (10 + 4095)), 0, 2},
+		{base.Add(time.Second * (10 + 4096)), 0, 2},
+		{midnight.Add(-time.Minute), 0, -1},
+	}
+	for _, c := range cases {
+		list := make([]types.ProcessInfo, 0)
+		found, err := db.QueryAsOf(c.timeline, c.lookback, &list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.expected < 0 {
+			if !found.IsZero() || len(list) != 0 {
+				t.Fatalf("%v: unexpected snapshot at %v", c.timeline, found)
+			}
+			continue
+		}
+		if !found.Equal(snapshots[c.expected]) || len(list) != 2 || list[0].Pid != int32(c.expected+1) {
+			t.Fatalf("%v: found %v with %d records, expected %v", c.timeline, found, len(list), snapshots[c.expected])
+		}
+	}
+	latest, err := snapsdb.QueryAsOf[types.ProcessInfo](db, base.Add(time.Hour), 0, snapsdb.WithFieldFilter("pid == 100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || !latest.Timeline.Equal(snapshots[2]) || len(latest.Data) != 1 {
+		t.Fatalf("unexpected latest snapshot %v", latest)
+	}
+	// 过滤后没有数据的时间线被跳过，继续向前查找
+	latest, err = snapsdb.QueryAsOf[types.ProcessInfo](db, base.Add(time.Hour), 0, snapsdb.WithFieldFilter("pid == 1"))
+	if err != nil || latest == nil || !latest.Timeline.Equal(snapshots[0]) || len(latest.Data) != 1 || latest.Data[0].Pid != 1 {
+		t.Fatalf("unexpected filtered snapshot %v, %v", latest, err)
+	}
+	if latest, err = snapsdb.QueryAsOf[types.ProcessInfo](db, base.Add(time.Hour), time.Minute*30, snapsdb.WithFieldFilter("pid == 2")); err != nil || latest != nil {
+		t.Fatalf("unexpected filtered snapshot out of the lookback %v, %v", latest, err)
+	}
+	if latest, err = snapsdb.QueryAsOf[types.ProcessInfo](db, midnight.Add(-time.Hour), time.Minute); err != nil || latest != nil {
+		t.Fatalf("unexpected snapshot %v, %v", latest, err)
+	}
+}
@@ -0,0 +1,156 @@
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+)
+
+// 测试 数据记录校验和
+func TestRecordChecksum(t *testing.T) {
+	dataPath := t.TempDir()
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	db.Write(timestamp, &types.ProcessInfo{Pid: 1, Name: "docker-compose - 1"}, &types.ProcessInfo{Pid: 2, Name: "docker-compose - 2"})
+	db.Dispose()
+
+	// flip one bit in the data of the first record
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(timestamp)))
+	file, err := os.OpenFile(filename, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := snapsdb.FileHeaderSize + snapsdb.TimelineLengthOfDay*snapsdb.MateInfoSize64 + snapsdb.ChecksumDataHeaderLen64 + 4
+	value := make([]byte, 1)
+	file.ReadAt(value, address)
+	value[0] ^= 0x10
+	file.WriteAt(value, address)
+	file.Close()
+
+	db, err = snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]types.ProcessInfo, 0)
+	err = db.QueryTimeline(timestamp, &list)
+	var corruptErr *snapsdb.CorruptRecordError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("expected a corrupt record error, got %v", err)
+	}
+	fmt.Println(util.Yellow(corruptErr.Error()))
+	db.Dispose()
+
+	corrupted := 0
+	db, err = snapsdb.InitDB(
+		snapsdb.WithDataPath(dataPath),
+		snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+		snapsdb.WithCorruptRecordHandler(func(err *snapsdb.CorruptRecordError) { corrupted++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	list = make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil {
+		t.Fatal(err)
+	}
+	if corrupted != 1 || len(list) != 1 || list[0].Pid != 2 {
+		t.Fatalf("expected the corrupt record to be skipped, got %d %v", corrupted, list)
+	}
+}
+
+// 测试 损坏的记录长度在分配缓冲区之前被检查
+func TestRecordLengthBeyondFile(t *testing.T) {
+	dataPath := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	db.Write(timestamp, &types.ProcessInfo{Pid: 1, Name: "docker-compose - 1"})
+	db.Dispose()
+
+	// the length of the first record
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(timestamp)))
+	file, err := os.OpenFile(filename, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, 0xFFFFFFF0)
+	file.WriteAt(length, snapsdb.FileHeaderSize+snapsdb.TimelineLengthOfDay*snapsdb.MateInfoSize64+16)
+	file.Close()
+
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	list := make([]types.ProcessInfo, 0)
+	err = db.QueryTimeline(timestamp, &list)
+	runtime.ReadMemStats(&after)
+	var corruptErr *snapsdb.CorruptRecordError
+	if !errors.As(err, &corruptErr) || !strings.Contains(corruptErr.Reason, "exceeds the end of the file") {
+		t.Fatalf("expected a corrupt record error, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("%d bytes allocated for a damaged record length", allocated)
+	}
+}
+
+// 测试 指向之前记录的记录链不会使查询陷入循环
+func TestBackwardRecordChain(t *testing.T) {
+	dataPath := t.TempDir()
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	db.Write(timestamp, &types.ProcessInfo{Pid: 1})
+	db.Write(timestamp, &types.ProcessInfo{Pid: 2})
+	db.Dispose()
+
+	// the last record of the chain points back to the first one
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(timestamp)))
+	file, err := os.OpenFile(filename, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := make([]byte, snapsdb.MateInfoSize64)
+	file.ReadAt(entry, snapsdb.FileHeaderSize+(timestamp.Unix()-util.GetUnixOfDay(timestamp))*snapsdb.MateInfoSize64)
+	file.WriteAt(entry[:8], int64(binary.LittleEndian.Uint64(entry[8:]))+snapsdb.NextDataOffset)
+	file.Close()
+
+	corrupted := 0
+	db, err = snapsdb.InitDB(
+		snapsdb.WithDataPath(dataPath),
+		snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+		snapsdb.WithCorruptRecordHandler(func(err *snapsdb.CorruptRecordError) { corrupted++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil {
+		t.Fatal(err)
+	}
+	if corrupted != 1 || len(list) != 2 || list[1].Pid != 2 {
+		t.Fatalf("expected the chain to end at the backward pointer, got %d %v", corrupted, list)
+	}
+}
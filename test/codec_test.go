@@ -0,0 +1,121 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+type sample struct {
+	Host   string
+	Load   float64
+	Labels map[string]string
+}
+
+// 测试 非 protobuf 编码的数据写入与查询
+func TestCodecs(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for _, codec := range []snapsdb.Codec{snapsdb.JSONCodec, snapsdb.GobCodec} {
+		path := t.TempDir()
+		db, err := snapsdb.InitDB(snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithCodec(codec), snapsdb.WithCompression(snapsdb.CompressionFlate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			err = db.WriteObjects(base.Add(time.Second*time.Duration(i)), &sample{Host: "web-1", Load: float64(i), Labels: map[string]string{"zone": "a"}}, sample{Host: "web-2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		page, err := snapsdb.QueryObjects[sample](db, base, base.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Timelines) != 3 || len(page.Timelines[2].Data) != 2 {
+			t.Fatalf("codec %d: unexpected page %+v", codec.ID(), page)
+		}
+		if first := page.Timelines[2].Data[0]; first.Host != "web-1" || first.Load != 2 || first.Labels["zone"] != "a" {
+			t.Fatalf("codec %d: unexpected object %+v", codec.ID(), first)
+		}
+		// 复用的对象中不应残留上一条数据的字段
+		if second := page.Timelines[2].Data[1]; second.Host != "web-2" || second.Load != 0 || second.Labels != nil {
+			t.Fatalf("codec %d: unexpected object %+v", codec.ID(), second)
+		}
+		list := make([]*sample, 0)
+		if err = db.QueryTimeline(base.Add(time.Second), &list); err != nil || len(list) != 2 || list[0].Load != 1 {
+			t.Fatalf("codec %d: unexpected timeline %v, %v", codec.ID(), list, err)
+		}
+		if err = db.QueryTimeline(base, &list, snapsdb.WithFieldFilter("Load > 1")); err == nil {
+			t.Fatalf("codec %d: a field filter was accepted for plain structs", codec.ID())
+		}
+		db.Dispose()
+		// 已有文件的编码与数据库不一致
+		db, err = snapsdb.InitDB(snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Write(base, &types.ProcessInfo{Pid: 1}); err == nil {
+			t.Fatalf("codec %d: a file of another codec was written", codec.ID())
+		}
+		db.Dispose()
+	}
+}
+
+// 测试 protobuf 消息使用 JSON 编码以及原始二进制编码
+func TestJSONAndBinaryCodecs(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithCodec(snapsdb.JSONCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if err = db.Write(base, &types.ProcessInfo{Pid: 1, Name: "nginx", Cpu: 80}, &types.ProcessInfo{Pid: 2, Name: "java"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, base, snapsdb.WithFieldFilter("cpu > 50"))
+	if err != nil || len(list) != 1 || list[0].Name != "nginx" {
+		t.Fatalf("unexpected messages %v, %v", list, err)
+	}
+	count := 0
+	err = db.Iterate(base, base.Add(time.Minute), &types.ProcessInfo{}, func(timeline time.Time, message snapsdb.StoreData) bool {
+		count++
+		return message.(*types.ProcessInfo).Pid == int32(count)
+	})
+	if err != nil || count != 2 {
+		t.Fatalf("unexpected iteration %d, %v", count, err)
+	}
+	if err = db.WritePoints(base, &snapsdb.DataPoint{}); err != snapsdb.ErrorPointCodec {
+		t.Fatalf("a data point was written with the json codec: %v", err)
+	}
+
+	raw, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithCodec(snapsdb.BinaryCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Dispose()
+	if err = raw.WriteObjects(base, snapsdb.Binary{1, 2, 3}, []byte("snaps")); err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.WriteObjects(base, "text"); err == nil {
+		t.Fatal("a string was written with the binary codec")
+	}
+	blobs := make([]snapsdb.Binary, 0)
+	if err = raw.QueryTimeline(base, &blobs); err != nil || len(blobs) != 2 || string(blobs[1]) != "snaps" || blobs[0][2] != 3 {
+		t.Fatalf("unexpected blobs %v, %v", blobs, err)
+	}
+
+	invalid := [][]snapsdb.Option{
+		{snapsdb.WithCodec(snapsdb.GobCodec), snapsdb.WithIndex("pid")},
+		{snapsdb.WithCodec(snapsdb.JSONCodec), snapsdb.WithDeltaEncoding("pid", 10)},
+		{snapsdb.WithCodec(nil)},
+	}
+	for i, opts := range invalid {
+		opts = append(opts, snapsdb.WithDataPath(t.TempDir()))
+		if db, err := snapsdb.InitDB(opts...); err == nil {
+			db.Dispose()
+			t.Fatalf("case %d: invalid codec options accepted", i)
+		}
+	}
+}
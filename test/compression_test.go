@@ -0,0 +1,59 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+)
+
+// 测试 压缩存储的写入与查询
+func TestCompression(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	sizes := make(map[snapsdb.Compression]int64)
+	for _, compression := range []snapsdb.Compression{snapsdb.CompressionNone, snapsdb.CompressionFlate} {
+		dataPath := t.TempDir()
+		db, err := snapsdb.InitDB(
+			snapsdb.WithDataPath(dataPath),
+			snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+			snapsdb.WithCompression(compression),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 60; i++ {
+			array := make([]snapsdb.StoreData, 0)
+			for pid := 1; pid <= 50; pid++ {
+				array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("docker-compose - %d", pid), Cpu: float32(i), Mem: 91.23, Virt: 10000000000})
+			}
+			if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		outmap := make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base, base.Add(time.Second*59), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 60; i++ {
+			list := outmap[base.Unix()+int64(i)]
+			if len(list) != 50 || list[49].Pid != 50 || list[0].Cpu != float32(i) {
+				t.Fatalf("%s: unexpected records at %d: %d", compression, i, len(list))
+			}
+		}
+		db.Dispose()
+		stat, err := os.Stat(filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(base))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[compression] = stat.Size()
+	}
+	fmt.Printf("none %d bytes, flate %d bytes\n", sizes[snapsdb.CompressionNone], sizes[snapsdb.CompressionFlate])
+	if sizes[snapsdb.CompressionFlate] >= sizes[snapsdb.CompressionNone] {
+		t.Fatal("compressed file is not smaller")
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 写入的同时并发查询，go test -race ./test/ 检查数据竞争
+// 每次写入 20 条记录，查询只能看到完整的写入，写入超过 4 MiB 后文件会被重新映射
+func TestConcurrentReaders(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for _, delta := range []bool{false, true} {
+		opts := []snapsdb.Option{snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+		if delta {
+			opts = append(opts, snapsdb.WithDeltaEncoding("pid", 10))
+		}
+		db, err := snapsdb.InitDB(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const writes = 300
+		padding := strings.Repeat("x", 1024)
+		done := make(chan struct{})
+		errs := make(chan error, 16)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			for i := 0; i < writes; i++ {
+				array := make([]snapsdb.StoreData, 0)
+				for pid := 1; pid <= 20; pid++ {
+					array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("%s - %d", padding, i), Cpu: float32(i)})
+				}
+				if err := db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		check := func(key int64, list []types.ProcessInfo) error {
+			if len(list) != 0 && len(list) != 20 {
+				return fmt.Errorf("partial write visible at %d: %d records", key, len(list))
+			}
+			for n := range list {
+				if int64(list[n].Cpu) != key-base.Unix() {
+					return fmt.Errorf("record of timeline %d has cpu %v", key, list[n].Cpu)
+				}
+			}
+			return nil
+		}
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					outmap := make(map[int64][]types.ProcessInfo)
+					begin := base.Add(time.Second * time.Duration(r*writes/4))
+					if err := db.QueryBetween(begin, begin.Add(time.Second*writes/4), &outmap); err != nil {
+						errs <- err
+						return
+					}
+					for key, list := range outmap {
+						if err := check(key, list); err != nil {
+							errs <- err
+							return
+						}
+					}
+					list := make([]types.ProcessInfo, 0)
+					timeline := base.Add(time.Second * time.Duration(writes-1-r))
+					if err := db.QueryTimeline(timeline, &list); err != nil {
+						errs <- err
+						return
+					}
+					if err := check(timeline.Unix(), list); err != nil {
+						errs <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}(r)
+		}
+		// 并发打开其他日期的文件
+		for d := 1; d <= 4; d++ {
+			wg.Add(1)
+			go func(d int) {
+				defer wg.Done()
+				list := make([]types.ProcessInfo, 0)
+				if err := db.QueryTimeline(base.Add(-snapsdb.TimestampOf1Day*time.Duration(d)), &list); err != nil {
+					errs <- err
+				}
+			}(d)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("delta %v: %v", delta, err)
+		}
+		outmap := make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base, base.Add(time.Second*writes), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < writes; i++ {
+			if len(outmap[base.Unix()+int64(i)]) != 20 {
+				t.Fatalf("delta %v: unexpected records at %d", delta, i)
+			}
+		}
+		db.Dispose()
+	}
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 时间线覆盖与密度
+func TestCoverage(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 23, 59, 50, 0, time.Local)
+	// 0..4 秒与 跨天的 12..15 秒有数据，第 3 秒写入两次
+	for _, second := range []int{0, 1, 2, 3, 3, 4, 12, 13, 14, 15} {
+		if err = db.Write(base.Add(time.Second*time.Duration(second)), &types.ProcessInfo{Pid: 1}, &types.ProcessInfo{Pid: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coverage, err := db.Coverage(base.Add(-time.Second*5), base.Add(time.Second*20), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coverage.Length != 26 || !coverage.Has(base) || coverage.Has(base.Add(time.Second*5)) || !coverage.Has(base.Add(time.Second*13)) {
+		t.Fatalf("unexpected coverage %+v", coverage)
+	}
+	intervals := coverage.Intervals()
+	if len(intervals) != 2 || !intervals[0].Begin.Equal(base) || !intervals[0].End.Equal(base.Add(time.Second*5)) ||
+		!intervals[1].Begin.Equal(base.Add(time.Second*12)) || !intervals[1].End.Equal(base.Add(time.Second*16)) {
+		t.Fatalf("unexpected intervals %v", intervals)
+	}
+	// 每条记录保存一个对象
+	if coverage.Counts[5] != 2 || coverage.Counts[8] != 4 || coverage.Counts[10] != 0 || coverage.Counts[17] != 2 {
+		t.Fatalf("unexpected counts %v", coverage.Counts)
+	}
+	nearest := map[time.Duration]time.Duration{5: 4, 8: 4, 9: 12, 30: 15, -10: 0}
+	for at, expected := range nearest {
+		found, ok := coverage.Nearest(base.Add(time.Second * at))
+		if !ok || !found.Equal(base.Add(time.Second*expected)) {
+			t.Fatalf("nearest of %d: %v, expected %d", at, found, expected)
+		}
+	}
+	if coverage, err = db.Coverage(base.Add(time.Hour), base.Add(time.Hour*2), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(coverage.Intervals()) != 0 || coverage.Counts != nil {
+		t.Fatalf("unexpected coverage %+v", coverage)
+	}
+	if _, ok := coverage.Nearest(base.Add(time.Hour)); ok {
+		t.Fatal("nearest timeline of an empty range")
+	}
+}
@@ -40,6 +40,7 @@ func InitDB() snapsdb.SnapsDB {
 func TestSnapshotDBWrite(_ *testing.T) {
 	fmt.Println("开始测试")
 	db := InitDB()
+	defer db.Dispose()
 	v1 := &types.ProcessInfo{Pid: 1, Name: "docker-compose - 1", Cpu: 10.01, Mem: 91.23, Virt: 10000000000, Res: 110000000000000}
 	v2 := &types.ProcessInfo{Pid: 2, Name: "docker-compose - 2", Cpu: 20.02, Mem: 92.34, Virt: 20000000000, Res: 220000000000000}
 	v3 := &types.ProcessInfo{Pid: 3, Name: "docker-compose - 3", Cpu: 30.03, Mem: 93.45, Virt: 30000000000, Res: 330000000000000}
@@ -70,6 +71,7 @@ func TestSnapshotDBWrite(_ *testing.T) {
 func TestSnapshotDBWriteOnce(t *testing.T) {
 	fmt.Println("开始测试")
 	db := InitDB()
+	defer db.Dispose()
 	v1 := &types.ProcessInfo{Pid: 1, Name: "docker-compose - 1", Cpu: 10.01, Mem: 91.23, Virt: 10000000000, Res: 110000000000000}
 	v2 := &types.ProcessInfo{Pid: 2, Name: "docker-compose - 2", Cpu: 20.02, Mem: 92.34, Virt: 20000000000, Res: 220000000000000}
 	v3 := &types.ProcessInfo{Pid: 3, Name: "docker-compose - 3", Cpu: 30.03, Mem: 93.45, Virt: 30000000000, Res: 330000000000000}
@@ -86,6 +88,7 @@ func TestSnapshotDBWriteOnce(t *testing.T) {
 // 测试 snapshotDB 的时间线查询
 func TestSnapshotDBQuery(t *testing.T) {
 	db := InitDB()
+	defer db.Dispose()
 	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
 	list := make([]types.ProcessInfo, 0)
 	// list = append(list, types.ProcessInfo{Pid: 5, Name: "docker-compose - 1111", Cpu: 50.05, Mem: 95.67, Virt: 50000000000, Res: 550000000000000})
@@ -102,6 +105,7 @@ func TestSnapshotDBQuery(t *testing.T) {
 // 测试 snapshotDB 的时间段查询
 func TestSnapshotDBQueryBetween(t *testing.T) {
 	db := InitDB()
+	defer db.Dispose()
 	beginTimestamp := time.Date(2022, 9, 22, 5, 0, 00, 0, time.Local)
 	endTimestamp := time.Date(2022, 9, 22, 5, 2, 00, 0, time.Local)
 	outmap := make(map[string][]types.ProcessInfo)
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// 第 i 次快照的进程列表，每次有进程的 cpu 变化，也有进程启动与退出
+func deltaSnapshot(i int) []*types.ProcessInfo {
+	list := make([]*types.ProcessInfo, 0)
+	for pid := 1; pid <= 50; pid++ {
+		if (pid+i)%17 == 0 {
+			continue
+		}
+		cpu := float32(1)
+		if pid%5 == i%5 {
+			cpu = float32(i)
+		}
+		list = append(list, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("docker-compose - %d", pid), Cpu: cpu, Mem: 91.23, Virt: 10000000000})
+	}
+	return list
+}
+
+// 测试 差量编码的写入与查询
+func TestDeltaEncoding(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	sizes := make(map[bool]int64)
+	for _, delta := range []bool{false, true} {
+		dataPath := t.TempDir()
+		opts := []snapsdb.Option{snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+		if delta {
+			opts = append(opts, snapsdb.WithDeltaEncoding("pid", 10))
+		}
+		db, err := snapsdb.InitDB(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := func(i int) {
+			array := make([]snapsdb.StoreData, 0)
+			for _, item := range deltaSnapshot(i) {
+				array = append(array, item)
+			}
+			if err := db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 30; i++ {
+			write(i)
+		}
+		// 重新打开后从关键帧继续写入
+		db.Dispose()
+		if db, err = snapsdb.InitDB(opts...); err != nil {
+			t.Fatal(err)
+		}
+		for i := 30; i < 60; i++ {
+			write(i)
+		}
+		// 倒序查询，每次都要从关键帧重建
+		for i := 59; i >= 0; i-- {
+			list := make([]types.ProcessInfo, 0)
+			if err = db.QueryTimeline(base.Add(time.Second*time.Duration(i)), &list); err != nil {
+				t.Fatal(err)
+			}
+			expected := deltaSnapshot(i)
+			if len(list) != len(expected) {
+				t.Fatalf("delta %v: %d records at %d, expected %d", delta, len(list), i, len(expected))
+			}
+			for n := range list {
+				if !proto.Equal(&list[n], expected[n]) {
+					t.Fatalf("delta %v: record %d at %d is %v, expected %v", delta, n, i, &list[n], expected[n])
+				}
+			}
+		}
+		outmap := make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base, base.Add(time.Second*59), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 60; i++ {
+			list := outmap[base.Unix()+int64(i)]
+			expected := deltaSnapshot(i)
+			if len(list) != len(expected) || !proto.Equal(&list[len(list)-1], expected[len(expected)-1]) {
+				t.Fatalf("delta %v: unexpected records at %d: %d", delta, i, len(list))
+			}
+		}
+		db.Dispose()
+		stat, err := os.Stat(filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(base))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[delta] = stat.Size()
+	}
+	fmt.Printf("full %d bytes, delta %d bytes\n", sizes[false], sizes[true])
+	if sizes[true] >= sizes[false] {
+		t.Fatal("delta encoded file is not smaller")
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 查询时按条件过滤数据
+func TestQueryFilter(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		array := make([]snapsdb.StoreData, 0)
+		for pid := 1; pid <= 20; pid++ {
+			name := fmt.Sprintf("nginx-%d", pid)
+			if pid%4 == 0 {
+				name = fmt.Sprintf("java -jar app-%d.jar", pid)
+			}
+			array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: name, Cpu: float32(pid * 5), Virt: uint64(pid) << 40})
+		}
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expressions := map[string]int{
+		`pid == 12`:                               1,
+		`pid != 12`:                               19,
+		`name startswith "java"`:                  5,
+		`name startswith 'java' && cpu > 80`:      1,
+		`cpu >= 95 || pid < 2`:                    3,
+		`name contains "app-1"`:                   2,
+		`cpu > 80.5`:                              4,
+		`virt > 17592186044416`:                   4,
+		`pid > 18 || pid == 1 && name == nginx-1`: 3,
+	}
+	for expression, expected := range expressions {
+		list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, base, snapsdb.WithFieldFilter(expression))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != expected {
+			t.Fatalf("%s: %d records, expected %d", expression, len(list), expected)
+		}
+	}
+	for _, expression := range []string{`pid ==`, `unknown == 1`, `pid == abc`, `name > 1 &&`, `cpu startswith "1"`, `pid ~ 1`, `name == "java`} {
+		if _, err = snapsdb.QueryTimeline[types.ProcessInfo](db, base, snapsdb.WithFieldFilter(expression)); err == nil {
+			t.Fatalf("invalid expression %s accepted", expression)
+		}
+	}
+	// Go 函数过滤与区间查询
+	outmap := make(map[int64][]types.ProcessInfo)
+	err = db.QueryBetween(base, base.Add(time.Second*9), &outmap, snapsdb.WithFilter(func(message snapsdb.StoreData) bool {
+		return message.(*types.ProcessInfo).Pid%2 == 0
+	}), snapsdb.WithFieldFilter("pid <= 10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if list := outmap[base.Unix()+int64(i)]; len(list) != 5 || list[0].Pid != 2 {
+			t.Fatalf("unexpected filtered records at %d: %d", i, len(list))
+		}
+	}
+	timelines, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Second*9), snapsdb.WithFieldFilter("pid > 100"))
+	if err != nil || len(timelines) != 0 {
+		t.Fatalf("timelines without matching records returned: %d, %v", len(timelines), err)
+	}
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// write a format version 1 storage file with one chain of records at timestamp
+func writeLegacyFile(t *testing.T, dataPath string, timestamp time.Time, data ...proto.Message) string {
+	baseline := util.GetUnixOfDay(timestamp)
+	buf := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(buf, binary.LittleEndian, snapsdb.LegacyMagicCode)
+	binary.Write(buf, binary.LittleEndian, baseline)
+	table := make([]byte, snapsdb.TimelineLengthOfDay*snapsdb.MateInfoSize)
+	records := bytes.NewBuffer(make([]byte, 0))
+	position := uint32(snapsdb.LegacyFileHeaderSize + int64(len(table)))
+	entry := table[(timestamp.Unix()-baseline)*snapsdb.MateInfoSize:]
+	binary.LittleEndian.PutUint32(entry, position)
+	for i, item := range data {
+		outdata, _ := proto.Marshal(item)
+		binary.LittleEndian.PutUint32(entry[4:], position)
+		next := position + snapsdb.DataHeaderLen + uint32(len(outdata))
+		if i == len(data)-1 {
+			next = 0
+		}
+		binary.Write(records, binary.LittleEndian, timestamp.Unix())
+		binary.Write(records, binary.LittleEndian, next)
+		binary.Write(records, binary.LittleEndian, uint32(len(outdata)))
+		records.Write(outdata)
+		position += snapsdb.DataHeaderLen + uint32(len(outdata))
+	}
+	buf.Write(table)
+	buf.Write(records.Bytes())
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", baseline))
+	if err := os.WriteFile(filename, buf.Bytes(), 0777); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// 测试 旧版数据文件的读取与迁移
+func TestFormatMigration(t *testing.T) {
+	dataPath := t.TempDir()
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	filename := writeLegacyFile(t, dataPath, timestamp, &types.ProcessInfo{Pid: 1}, &types.ProcessInfo{Pid: 2})
+
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 records from the legacy file, got %v %v", list, err)
+	}
+	// a side by side copy leaves the source untouched
+	copyname := filepath.Join(t.TempDir(), filepath.Base(filename))
+	if ok, err := snapsdb.MigrateFile(filename, copyname); !ok || err != nil {
+		t.Fatalf("side by side migration failed: %v %v", ok, err)
+	}
+	if report, err := snapsdb.VerifyFile(copyname, false); err != nil || !report.OK() || report.Records != 2 {
+		t.Fatalf("unexpected migrated copy: %v %v", report, err)
+	}
+
+	migrated, err := db.Migrate()
+	if err != nil || len(migrated) != 1 {
+		t.Fatalf("expected one migrated file, got %v %v", migrated, err)
+	}
+	header := make([]byte, snapsdb.FileHeaderSize)
+	content, _ := os.ReadFile(filename)
+	copy(header, content)
+	if binary.LittleEndian.Uint64(header) != snapsdb.MagicCode || binary.LittleEndian.Uint32(header[28:]) != snapsdb.CurrentFormatVersion {
+		t.Fatal("the file was not rewritten in the current format")
+	}
+	db.Write(timestamp, &types.ProcessInfo{Pid: 3})
+	list = make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil || len(list) != 3 || list[2].Pid != 3 {
+		t.Fatalf("expected 3 records after migration, got %v %v", list, err)
+	}
+	if migrated, _ = db.Migrate(); len(migrated) != 0 {
+		t.Fatalf("expected nothing to migrate, got %v", migrated)
+	}
+}
+
+// 测试 记录链指向之前的记录时迁移返回错误
+func TestMigrateBackwardChain(t *testing.T) {
+	dataPath := t.TempDir()
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	filename := writeLegacyFile(t, dataPath, timestamp, &types.ProcessInfo{Pid: 1}, &types.ProcessInfo{Pid: 2})
+	// the first record points to itself
+	first := uint32(snapsdb.LegacyFileHeaderSize + snapsdb.TimelineLengthOfDay*snapsdb.MateInfoSize)
+	next := make([]byte, 4)
+	binary.LittleEndian.PutUint32(next, first)
+	file, err := os.OpenFile(filename, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(next, int64(first)+snapsdb.NextDataOffset)
+	file.Close()
+	var corrupt *snapsdb.CorruptRecordError
+	if ok, err := snapsdb.MigrateFile(filename, filepath.Join(t.TempDir(), filepath.Base(filename))); ok || !errors.As(err, &corrupt) {
+		t.Fatalf("expected a corrupt record error, got %v %v", ok, err)
+	}
+}
+
+// 测试 32位地址的旧版文件超过 4 GiB 时返回错误
+func TestLegacyFileOverflow(t *testing.T) {
+	dataPath := t.TempDir()
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	filename := writeLegacyFile(t, dataPath, timestamp, &types.ProcessInfo{Pid: 1})
+	// grow the file (sparse) to just below 4 GiB
+	if err := os.Truncate(filename, 1<<32-8); err != nil {
+		t.Skip(err)
+	}
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if err = db.Write(timestamp, &types.ProcessInfo{Pid: 2, Name: "docker-compose"}); err != snapsdb.ErrorFileTooLarge {
+		t.Fatalf("expected ErrorFileTooLarge, got %v", err)
+	}
+	if _, err = db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Write(timestamp, &types.ProcessInfo{Pid: 2, Name: "docker-compose"}); err != nil {
+		t.Fatal(err)
+	}
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 records after migration, got %v %v", list, err)
+	}
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 泛型查询，以及错误的参数类型返回错误而不是 panic
+func TestGenericQuery(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i += 2 {
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: int32(i), Name: "a"}, &types.ProcessInfo{Pid: int32(i), Name: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, base.Add(time.Second*4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Pid != 4 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Fatalf("unexpected timeline data %v", list)
+	}
+	timelines, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Second*9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timelines) != 5 {
+		t.Fatalf("%d timelines, expected 5", len(timelines))
+	}
+	for i, timeline := range timelines {
+		if !timeline.Timeline.Equal(base.Add(time.Second*time.Duration(i*2))) || len(timeline.Data) != 2 || timeline.Data[1].Pid != int32(i*2) {
+			t.Fatalf("unexpected timeline %d: %v", i, timeline.Timeline)
+		}
+	}
+	// 指针切片
+	pointers := make(map[int64][]*types.ProcessInfo)
+	if err = db.QueryBetween(base, base.Add(time.Second*9), &pointers); err != nil {
+		t.Fatal(err)
+	}
+	if len(pointers[base.Unix()+8]) != 2 || pointers[base.Unix()+8][0].Pid != 8 {
+		t.Fatalf("unexpected pointer slice %v", pointers[base.Unix()+8])
+	}
+	invalid := []interface{}{nil, list, &map[int64]types.ProcessInfo{}, &map[float64][]types.ProcessInfo{}, &map[int64][]int{}, &map[int64][]time.Time{}}
+	for _, out := range invalid {
+		if err = db.QueryBetween(base, base.Add(time.Second), out); err == nil {
+			t.Fatalf("query between into %T did not fail", out)
+		}
+	}
+	for _, out := range []interface{}{nil, list, &map[int64][]types.ProcessInfo{}, &[]int{}} {
+		if err = db.QueryTimeline(base, out); err == nil {
+			t.Fatalf("query timeline into %T did not fail", out)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 二级索引查询
+func TestQueryIndex(t *testing.T) {
+	formats := map[string][]snapsdb.Option{
+		"plain":      nil,
+		"compressed": {snapsdb.WithCompression(snapsdb.CompressionFlate)},
+		"delta":      {snapsdb.WithDeltaEncoding("pid", 4)},
+	}
+	for name, options := range formats {
+		t.Run(name, func(t *testing.T) {
+			testQueryIndex(t, options)
+		})
+	}
+}
+
+func testQueryIndex(t *testing.T, options []snapsdb.Option) {
+	path := t.TempDir()
+	options = append(options, snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	db, err := snapsdb.InitDB(append(options, snapsdb.WithIndex("pid"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	end := base.Add(time.Hour * 48)
+	// 跨两天写入，第二天的数据无索引时写入
+	for i := 0; i < 10; i++ {
+		array := make([]snapsdb.StoreData, 0)
+		for pid := 0; pid < 20; pid++ {
+			if pid == 7 && i%2 == 1 {
+				continue
+			}
+			array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("proc-%d", pid), Cpu: float32(i)})
+		}
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db snapsdb.SnapsDB, value interface{}, expected int) {
+		page, err := snapsdb.QueryIndex[types.ProcessInfo](db, base, end, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Timelines) != expected {
+			t.Fatalf("pid %v: %d timelines, expected %d", value, len(page.Timelines), expected)
+		}
+		for i, timeline := range page.Timelines {
+			if len(timeline.Data) != 1 || fmt.Sprint(timeline.Data[0].Pid) != fmt.Sprint(value) {
+				t.Fatalf("pid %v: unexpected data %v at %v", value, timeline.Data, timeline.Timeline)
+			}
+			if i > 0 && !timeline.Timeline.After(page.Timelines[i-1].Timeline) {
+				t.Fatalf("timelines out of order")
+			}
+		}
+	}
+	check(db, 3, 10)
+	check(db, int32(7), 5)
+	check(db, 0, 10)
+	check(db, 99, 0)
+	page, err := snapsdb.QueryIndex[types.ProcessInfo](db, base, end, 3, snapsdb.WithPageSize(4), snapsdb.WithFieldFilter("cpu >= 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Timelines) != 4 || page.Timelines[0].Data[0].Cpu != 2 || page.Next == "" {
+		t.Fatalf("unexpected page %v", page.Timelines)
+	}
+	if _, err = snapsdb.QueryIndex[types.ProcessInfo](db, base, end, "3"); err == nil {
+		t.Fatal("a string value of an int32 field accepted")
+	}
+	db.Dispose()
+
+	// 无索引时写入的数据在下次查询前补齐
+	db, err = snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := base.Add(snapsdb.TimestampOf1Day)
+	if err = db.Write(next, &types.ProcessInfo{Pid: 3}, &types.ProcessInfo{Pid: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snapsdb.QueryIndex[types.ProcessInfo](db, base, end, 3); err != snapsdb.ErrorNoIndex {
+		t.Fatalf("expected ErrorNoIndex, got %v", err)
+	}
+	db.Dispose()
+	db, err = snapsdb.InitDB(append(options, snapsdb.WithIndex("pid"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, 3, 11)
+	check(db, 7, 6)
+	db.Dispose()
+
+	// 删除索引文件后重建
+	files, _ := filepath.Glob(filepath.Join(path, "*.idx"))
+	if len(files) != 2 {
+		t.Fatalf("%d index files, expected 2", len(files))
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	db, err = snapsdb.InitDB(append(options, snapsdb.WithIndex("pid"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	check(db, 3, 11)
+	check(db, 0, 10)
+}
+
+// 测试 大量索引项分块写入，重新打开（有或没有目录）后查询
+func TestIndexBlocks(t *testing.T) {
+	path := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithIndex("pid")}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	end := base.Add(time.Hour)
+	// 600 个时间线，每个 20 个进程，超过一次写入索引块的数量
+	for i := 0; i < 600; i++ {
+		array := make([]snapsdb.StoreData, 0)
+		for pid := 0; pid < 20; pid++ {
+			array = append(array, &types.ProcessInfo{Pid: int32(pid), Cpu: float32(i)})
+		}
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db snapsdb.SnapsDB) {
+		for _, pid := range []int{0, 7, 19} {
+			page, err := snapsdb.QueryIndex[types.ProcessInfo](db, base, end, pid, snapsdb.WithPageSize(1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Timelines) != 600 {
+				t.Fatalf("pid %d: %d timelines, expected 600", pid, len(page.Timelines))
+			}
+			for i, timeline := range page.Timelines {
+				if len(timeline.Data) != 1 || timeline.Data[0].Pid != int32(pid) || timeline.Data[0].Cpu != float32(i) {
+					t.Fatalf("pid %d: unexpected data %v at %v", pid, timeline.Data, timeline.Timeline)
+				}
+			}
+		}
+		page, err := snapsdb.QueryIndex[types.ProcessInfo](db, base.Add(time.Second*100), base.Add(time.Second*109), 3)
+		if err != nil || len(page.Timelines) != 10 || page.Timelines[0].Data[0].Cpu != 100 {
+			t.Fatalf("unexpected range page %v, %v", page, err)
+		}
+	}
+	check(db)
+	db.Dispose()
+	// 关闭时写入目录
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Dispose()
+	// 目录损坏时重新读取索引块
+	files, _ := filepath.Glob(filepath.Join(path, "*.idx"))
+	if len(files) != 1 {
+		t.Fatalf("%d index files, expected 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err = os.WriteFile(files[0], data, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	check(db)
+}
+
+// 测试 修复数据文件后删除旧的索引文件，重新打开时重建索引
+func TestIndexAfterRepair(t *testing.T) {
+	path := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithIndex("pid")}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = snapsdb.QueryIndex[types.ProcessInfo](db, base, base.Add(time.Minute), 2); err != nil {
+		t.Fatal(err)
+	}
+	db.Dispose()
+	files, _ := filepath.Glob(filepath.Join(path, "*.bin"))
+	indexFiles, _ := filepath.Glob(filepath.Join(path, "*.idx"))
+	if len(files) != 1 || len(indexFiles) != 1 {
+		t.Fatalf("unexpected files %v %v", files, indexFiles)
+	}
+	// cut the last record
+	stat, _ := os.Stat(files[0])
+	if err = os.Truncate(files[0], stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := snapsdb.VerifyFile(files[0], true); err != nil || !report.Repaired {
+		t.Fatalf("expected the file to be repaired, got %v %v", report, err)
+	}
+	if _, err = os.Stat(indexFiles[0]); !os.IsNotExist(err) {
+		t.Fatalf("the index of the repaired file was kept: %v", err)
+	}
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if err = db.Write(base.Add(time.Second*3), &types.ProcessInfo{Pid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for pid, expected := range map[int]int{0: 1, 1: 1, 2: 1} {
+		page, err := snapsdb.QueryIndex[types.ProcessInfo](db, base, base.Add(time.Minute), pid)
+		if err != nil || len(page.Timelines) != expected || page.Timelines[0].Data[0].Pid != int32(pid) {
+			t.Fatalf("pid %d: unexpected page %+v, %v", pid, page, err)
+		}
+	}
+}
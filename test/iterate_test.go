@@ -0,0 +1,53 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 跨天的流式查询与提前终止
+func TestIterate(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	// 跨越午夜的 120 秒
+	begin := time.Date(2022, 9, 22, 23, 59, 0, 0, time.Local)
+	for i := 0; i < 120; i++ {
+		if err = db.Write(begin.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: int32(i), Name: "a"}, &types.ProcessInfo{Pid: int32(i), Name: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	process := &types.ProcessInfo{}
+	count := 0
+	var last time.Time
+	err = db.Iterate(begin, begin.Add(time.Second*119), process, func(timeline time.Time, message snapsdb.StoreData) bool {
+		if timeline.Before(last) || timeline.Unix()-begin.Unix() != int64(process.Pid) {
+			t.Fatalf("record pid %d at %v out of order", process.Pid, timeline)
+		}
+		if (count%2 == 0) != (process.Name == "a") {
+			t.Fatalf("record %d of timeline %v out of order", count, timeline)
+		}
+		last = timeline
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 240 {
+		t.Fatalf("iterated %d records, expected 240", count)
+	}
+	count = 0
+	err = db.Iterate(begin, begin.Add(time.Second*119), process, func(timeline time.Time, message snapsdb.StoreData) bool {
+		count++
+		return count < 75
+	})
+	if err != nil || count != 75 {
+		t.Fatalf("iteration did not stop: %d records, %v", count, err)
+	}
+}
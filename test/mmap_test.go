@@ -0,0 +1,72 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 内存映射读取与 ReadAt 读取的结果一致，映射之后追加的记录通过 ReadAt 读取
+func TestMemoryMap(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	results := make(map[bool]map[int64][]types.ProcessInfo)
+	for _, mmap := range []bool{false, true} {
+		opts := []snapsdb.Option{
+			snapsdb.WithDataPath(t.TempDir()),
+			snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+			snapsdb.WithMemoryMap(mmap),
+		}
+		db, err := snapsdb.InitDB(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := func(i int) {
+			array := make([]snapsdb.StoreData, 0)
+			for pid := 1; pid <= 20; pid++ {
+				array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: fmt.Sprintf("docker-compose - %d", pid), Cpu: float32(i)})
+			}
+			if err := db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			write(i)
+		}
+		db.Dispose()
+		if db, err = snapsdb.InitDB(opts...); err != nil {
+			t.Fatal(err)
+		}
+		outmap := make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base, base.Add(time.Second*99), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		if len(outmap[base.Unix()+99]) != 20 {
+			t.Fatalf("mmap %v: unexpected records before growth: %d", mmap, len(outmap[base.Unix()+99]))
+		}
+		// 映射之后追加的记录
+		for i := 100; i < 200; i++ {
+			write(i)
+		}
+		outmap = make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base, base.Add(time.Second*199), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		results[mmap] = outmap
+		db.Dispose()
+	}
+	for i := 0; i < 200; i++ {
+		key := base.Unix() + int64(i)
+		plain, mapped := results[false][key], results[true][key]
+		if len(plain) != 20 || len(mapped) != len(plain) {
+			t.Fatalf("unexpected records at %d: %d read, %d mapped", i, len(plain), len(mapped))
+		}
+		for n := range plain {
+			if plain[n].Pid != mapped[n].Pid || plain[n].Cpu != mapped[n].Cpu || plain[n].Name != mapped[n].Name {
+				t.Fatalf("record %d at %d differs", n, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+)
+
+type diskUsage struct {
+	Mount string
+	Free  uint64
+	Used  float32
+	inner int
+}
+
+// 测试 无 protobuf 定义的数据点写入与查询
+func TestDataPoints(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year), snapsdb.WithCompression(snapsdb.CompressionFlate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	boot := time.Date(2022, 9, 1, 8, 30, 0, 123, time.Local)
+	for i := 0; i < 3; i++ {
+		err = db.WritePoints(base.Add(time.Second*time.Duration(i)), &snapsdb.DataPoint{
+			Tags: snapsdb.TagPair{"host": "web-1", "cpu": i, "boot": boot},
+			Values: snapsdb.ValuePair{
+				"usage":   float64(i) * 1.5,
+				"load":    float32(0.25),
+				"threads": int32(-i),
+				"running": i%2 == 0,
+				"dump":    snapsdb.Binary{1, 2, 3},
+				"disk":    &diskUsage{Mount: "/", Free: 1 << 40, Used: 0.5, inner: 1},
+				"labels":  snapsdb.HashMap{"zone": "a", "rack": uint16(7)},
+				"ports":   []int{80, 443},
+				"none":    nil,
+			},
+		}, &snapsdb.DataPoint{Tags: snapsdb.TagPair{"host": "web-2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := snapsdb.QueryPoints(db, base, base.Add(time.Minute), snapsdb.WithPageSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Timelines) != 2 || page.Next == "" || len(page.Timelines[1].Data) != 2 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	point := page.Timelines[1].Data[0]
+	if point.Tags["host"] != "web-1" || point.Tags["cpu"] != 1 || !point.Tags["boot"].(time.Time).Equal(boot) {
+		t.Fatalf("unexpected tags %v", point.Tags)
+	}
+	values := point.Values
+	if values["usage"] != 1.5 || values["load"] != float32(0.25) || values["threads"] != int32(-1) || values["running"] != false || values["none"] != nil {
+		t.Fatalf("unexpected values %v", values)
+	}
+	if !bytes.Equal(values["dump"].([]byte), []byte{1, 2, 3}) {
+		t.Fatalf("unexpected bytes %v", values["dump"])
+	}
+	disk := values["disk"].(map[string]interface{})
+	if len(disk) != 3 || disk["Mount"] != "/" || disk["Free"] != uint64(1<<40) || disk["Used"] != float32(0.5) {
+		t.Fatalf("unexpected struct %v", disk)
+	}
+	labels := values["labels"].(map[string]interface{})
+	ports := values["ports"].([]interface{})
+	if labels["zone"] != "a" || labels["rack"] != uint16(7) || len(ports) != 2 || ports[1] != 443 {
+		t.Fatalf("unexpected nested values %v %v", labels, ports)
+	}
+	if second := page.Timelines[1].Data[1]; second.Tags["host"] != "web-2" || len(second.Values) != 0 {
+		t.Fatalf("unexpected point %v", second)
+	}
+	next, err := snapsdb.QueryPoints(db, base, base.Add(time.Minute), snapsdb.WithContinuation(page.Next))
+	if err != nil || len(next.Timelines) != 1 || next.Next != "" {
+		t.Fatalf("unexpected next page %+v, %v", next, err)
+	}
+	// 标签只能是标量
+	if err = db.WritePoints(base, &snapsdb.DataPoint{Tags: snapsdb.TagPair{"list": []int{1}}}); err == nil {
+		t.Fatal("a tag with a slice value was written")
+	}
+	if err = db.WritePoints(base, &snapsdb.DataPoint{Values: snapsdb.ValuePair{"channel": make(chan int)}}); err == nil {
+		t.Fatal("an unsupported value was written")
+	}
+	if _, err = snapsdb.QueryPoints(db, base, base.Add(time.Minute), snapsdb.WithFieldFilter("cpu > 1")); err == nil {
+		t.Fatal("a field filter was accepted for data points")
+	}
+	// 空数据点与自引用的值返回错误
+	if err = db.WritePoints(base, nil); err == nil {
+		t.Fatal("a nil data point was written")
+	}
+	loop := map[string]interface{}{}
+	loop["self"] = loop
+	if err = db.WritePoints(base, &snapsdb.DataPoint{Values: snapsdb.ValuePair{"loop": loop}}); err == nil {
+		t.Fatal("a map containing itself was written")
+	}
+	node := &treeNode{Name: "root"}
+	node.Next = node
+	if err = db.WritePoints(base, &snapsdb.DataPoint{Values: snapsdb.ValuePair{"node": node}}); err == nil {
+		t.Fatal("a struct pointing to itself was written")
+	}
+	// 有限的嵌套可以写入
+	nested := interface{}(1)
+	for i := 0; i < 20; i++ {
+		nested = []interface{}{nested}
+	}
+	if err = db.WritePoints(base.Add(time.Minute), &snapsdb.DataPoint{Values: snapsdb.ValuePair{"nested": nested}}); err != nil {
+		t.Fatal(err)
+	}
+	if page, err = snapsdb.QueryPoints(db, base.Add(time.Minute), base.Add(time.Minute)); err != nil || len(page.Timelines) != 1 {
+		t.Fatalf("unexpected nested points %+v, %v", page, err)
+	}
+}
+
+type treeNode struct {
+	Name string
+	Next *treeNode
+}
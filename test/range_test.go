@@ -0,0 +1,83 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 有序的区间查询，空时间线与分页
+func TestQueryRange(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	// 跨越午夜，每 3 秒写入一次
+	begin := time.Date(2022, 9, 22, 23, 59, 0, 0, time.Local)
+	end := begin.Add(time.Second * 119)
+	for i := 0; i < 120; i += 3 {
+		if err = db.Write(begin.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := snapsdb.QueryRange[types.ProcessInfo](db, begin, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Timelines) != 40 || result.Next != "" {
+		t.Fatalf("%d timelines, expected 40", len(result.Timelines))
+	}
+	for i, timeline := range result.Timelines {
+		if !timeline.Timeline.Equal(begin.Add(time.Second*time.Duration(i*3))) || len(timeline.Data) != 1 || timeline.Data[0].Pid != int32(i*3) {
+			t.Fatalf("unexpected timeline %d at %v", i, timeline.Timeline)
+		}
+	}
+	// 包含空时间线，第二天的文件不存在时按数据库的时间精度补齐
+	result, err = snapsdb.QueryRange[types.ProcessInfo](db, begin, end.Add(snapsdb.TimestampOf1Day), snapsdb.WithEmptyTimelines())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Timelines) != 120+86400 {
+		t.Fatalf("%d timelines with empty ones, expected %d", len(result.Timelines), 120+86400)
+	}
+	for i := 0; i < 120; i++ {
+		expected := 0
+		if i%3 == 0 {
+			expected = 1
+		}
+		if len(result.Timelines[i].Data) != expected {
+			t.Fatalf("unexpected data at %d", i)
+		}
+	}
+	// 分页读取与一次读取的结果一致
+	pages, token := 0, ""
+	collected := make([]snapsdb.TimelineData[types.ProcessInfo], 0)
+	for {
+		page, err := snapsdb.QueryRange[types.ProcessInfo](db, begin, end, snapsdb.WithPageSize(7), snapsdb.WithContinuation(token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		collected = append(collected, page.Timelines...)
+		if token = page.Next; token == "" {
+			break
+		}
+		if len(page.Timelines) != 7 {
+			t.Fatalf("page %d has %d timelines", pages, len(page.Timelines))
+		}
+	}
+	if pages != 6 || len(collected) != 40 {
+		t.Fatalf("%d pages with %d timelines, expected 6 pages with 40 timelines", pages, len(collected))
+	}
+	for i, timeline := range collected {
+		if timeline.Data[0].Pid != int32(i*3) {
+			t.Fatalf("unexpected paged timeline %d", i)
+		}
+	}
+	if _, err = snapsdb.QueryRange[types.ProcessInfo](db, begin, end, snapsdb.WithContinuation("not a token")); err != snapsdb.ErrorInvalidToken {
+		t.Fatalf("invalid token accepted: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 亚秒级时间精度的写入与查询
+func TestSubSecondResolution(t *testing.T) {
+	db, err := snapsdb.InitDB(
+		snapsdb.WithDataPath(t.TempDir()),
+		snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+		snapsdb.WithTimeResolution(time.Millisecond*100),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		timestamp := base.Add(time.Millisecond * time.Duration(i*100+50))
+		err = db.Write(timestamp, &types.ProcessInfo{Pid: int32(i), Name: "sampler"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(base.Add(time.Millisecond*320), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Pid != 3 {
+		t.Fatalf("expected pid 3 at +300ms, got %v", list)
+	}
+	snapshots := make(map[time.Time][]types.ProcessInfo)
+	if err = db.QueryBetween(base, base.Add(time.Millisecond*999), &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 10 {
+		t.Fatalf("expected 10 snapshots, got %d", len(snapshots))
+	}
+	for i := 0; i < 10; i++ {
+		list := snapshots[base.Add(time.Millisecond*time.Duration(i*100))]
+		if len(list) != 1 || list[0].Pid != int32(i) {
+			t.Fatalf("unexpected snapshot %d: %v", i, list)
+		}
+	}
+	seconds := make(map[int64][]types.ProcessInfo)
+	if err = db.QueryBetween(base, base.Add(time.Millisecond*999), &seconds); err != nil {
+		t.Fatal(err)
+	}
+	if len(seconds[base.Unix()]) != 10 {
+		t.Fatalf("expected 10 records merged into one second, got %d", len(seconds[base.Unix()]))
+	}
+	if _, err = snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithTimeResolution(time.Millisecond*300)); err == nil {
+		t.Fatal("expected invalid resolution error")
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 降采样层级的计算与自动选择
+func TestRollup(t *testing.T) {
+	path := t.TempDir()
+	// 小时层级保存每个时间线的数据条数
+	countReducer := func(timeline time.Time, objects []snapsdb.StoreData) []snapsdb.StoreData {
+		return []snapsdb.StoreData{&types.ProcessInfo{Name: "count", Pid: int32(len(objects))}}
+	}
+	options := []snapsdb.Option{
+		snapsdb.WithDataPath(path),
+		snapsdb.WithDataRetention(snapsdb.TimestampOf100Year),
+		snapsdb.WithRollupSelection(100),
+		snapsdb.WithRollup(
+			snapsdb.RollupTier{Resolution: time.Minute, Retention: snapsdb.TimestampOf100Year, Message: &types.ProcessInfo{}, Reducer: snapsdb.FieldReducer("pid", snapsdb.RollupAvg)},
+			snapsdb.RollupTier{Resolution: time.Hour, Retention: snapsdb.TimestampOf100Year, Message: &types.ProcessInfo{}, Reducer: countReducer},
+		),
+	}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for i := 0; i < 180; i++ {
+		array := make([]snapsdb.StoreData, 0)
+		for pid := 1; pid <= 3; pid++ {
+			array = append(array, &types.ProcessInfo{Pid: int32(pid), Name: "proc", Cpu: float32(i % 60 * pid), Res: uint64(i)})
+		}
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), array...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Rollup(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db snapsdb.SnapsDB) {
+		minutes, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Minute*3-1), snapsdb.WithResolution(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(minutes) != 3 {
+			t.Fatalf("%d minute timelines, expected 3", len(minutes))
+		}
+		for i, minute := range minutes {
+			if !minute.Timeline.Equal(base.Add(time.Minute*time.Duration(i))) || len(minute.Data) != 3 {
+				t.Fatalf("unexpected minute timeline %v", minute)
+			}
+			for j := range minute.Data {
+				process := &minute.Data[j]
+				// 0..59 的平均值为 29.5
+				if process.Cpu != 29.5*float32(process.Pid) || process.Res != uint64(i*60+30) {
+					t.Fatalf("unexpected rollup %v", process.String())
+				}
+			}
+		}
+		// 范围宽度自动选择层级
+		timelines, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Second*59))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timelines) != 60 {
+			t.Fatalf("%d timelines of a raw range, expected 60", len(timelines))
+		}
+		timelines, err = snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Minute*10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timelines) != 3 || len(timelines[0].Data) != 3 {
+			t.Fatalf("%d timelines of a minute range, expected 3", len(timelines))
+		}
+		outmap := make(map[int64][]types.ProcessInfo)
+		if err = db.QueryBetween(base.Add(-time.Hour*24), base.Add(time.Hour*24), &outmap); err != nil {
+			t.Fatal(err)
+		}
+		// 每个小时时间线都有 key
+		if len(outmap) != 24 || len(outmap[base.Unix()]) != 1 || outmap[base.Unix()][0].Pid != 540 {
+			t.Fatalf("unexpected hour rollup %v", outmap)
+		}
+	}
+	check(db)
+	// 已计算的时间线不会重复计算
+	if err = db.Rollup(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if _, err = snapsdb.QueryBetween[types.ProcessInfo](db, base, base, snapsdb.WithResolution(time.Second*10)); err == nil {
+		t.Fatal("unknown rollup resolution accepted")
+	}
+	db.Dispose()
+	if _, err = os.Stat(filepath.Join(path, "rollup-1m0s", "rollup.state")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if err = db.Rollup(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if _, err = snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithRollup(snapsdb.RollupTier{Resolution: time.Second * 7, Message: &types.ProcessInfo{}, Reducer: countReducer})); err == nil {
+		t.Fatal("invalid rollup resolution accepted")
+	}
+	for _, retention := range []time.Duration{0, -time.Hour} {
+		if _, err = snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithRollup(snapsdb.RollupTier{Resolution: time.Minute, Retention: retention, Message: &types.ProcessInfo{}, Reducer: countReducer})); err == nil {
+			t.Fatalf("rollup retention %v accepted", retention)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// a types.ProcessInfo message built at runtime with the pid field of the kind and an extra field
+func processInfoVersion(t *testing.T, pid descriptorpb.FieldDescriptorProto_Type, extra string) protoreflect.MessageDescriptor {
+	message := protodesc.ToDescriptorProto((&types.ProcessInfo{}).ProtoReflect().Descriptor())
+	message.Field[0].Type = pid.Enum()
+	if extra != "" {
+		message.Field = append(message.Field, &descriptorpb.FieldDescriptorProto{Name: proto.String(extra), Number: proto.Int32(7), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()})
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("evolved/processinfo.proto"),
+		Package:     proto.String("types"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{message},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Messages().Get(0)
+}
+
+// 测试 存储文件的消息类型记录与兼容性检查
+func TestSchema(t *testing.T) {
+	path := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	if err = db.Write(base, &types.ProcessInfo{Pid: 1, Name: "nginx"}, &types.ProcessInfo{Pid: 2, Name: "java"}); err != nil {
+		t.Fatal(err)
+	}
+	var schemaError *snapsdb.SchemaError
+	if err = db.Write(base, &wrapperspb.StringValue{Value: "x"}); !errors.As(err, &schemaError) {
+		t.Fatalf("a write of another message type: %v", err)
+	}
+	if err = db.Write(base, &types.ProcessInfo{}, &wrapperspb.StringValue{}); err == nil {
+		t.Fatal("a write mixing message types was accepted")
+	}
+	db.Dispose()
+
+	// 重新打开后从 schema 文件读取消息类型
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	descriptor, err := db.Schema(base)
+	if err != nil || descriptor.FullName() != "types.ProcessInfo" {
+		t.Fatalf("unexpected schema %v, %v", descriptor, err)
+	}
+	page, err := snapsdb.QueryDynamic(db, base, base.Add(time.Minute), snapsdb.WithFieldFilter(`name == "java"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Timelines) != 1 || len(page.Timelines[0].Data) != 1 {
+		t.Fatalf("unexpected dynamic page %+v", page)
+	}
+	message := page.Timelines[0].Data[0]
+	if pid := message.Get(message.Descriptor().Fields().ByName("pid")).Int(); pid != 2 {
+		t.Fatalf("unexpected dynamic message %v", message)
+	}
+	if _, err = snapsdb.QueryTimeline[wrapperspb.StringValue](db, base); !errors.As(err, &schemaError) {
+		t.Fatalf("a query of another message type: %v", err)
+	}
+	list := make([]wrapperspb.Int64Value, 0)
+	if err = db.QueryTimeline(base, &list); !errors.As(err, &schemaError) {
+		t.Fatalf("a query of another message type: %v", err)
+	}
+
+	// 兼容的新版本消息可以写入，不兼容的被拒绝
+	evolved := dynamicpb.NewMessage(processInfoVersion(t, descriptorpb.FieldDescriptorProto_TYPE_INT32, "threads"))
+	evolved.Set(evolved.Descriptor().Fields().ByNumber(1), protoreflect.ValueOfInt32(3))
+	evolved.Set(evolved.Descriptor().Fields().ByNumber(7), protoreflect.ValueOfInt64(12))
+	if err = db.Write(base.Add(time.Second), evolved); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor, _ = db.Schema(base); descriptor.Fields().ByNumber(7) == nil {
+		t.Fatal("the schema was not updated to the evolved message")
+	}
+	// 旧版本消息的写入不替换记录的新版本
+	if err = db.Write(base.Add(2*time.Second), &types.ProcessInfo{Pid: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor, _ = db.Schema(base); descriptor.Fields().ByNumber(7) == nil {
+		t.Fatal("an older message replaced the evolved schema")
+	}
+	processes, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Minute))
+	if err != nil || len(processes) != 3 || processes[1].Data[0].Pid != 3 {
+		t.Fatalf("unexpected processes %v, %v", processes, err)
+	}
+	incompatible := dynamicpb.NewMessage(processInfoVersion(t, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""))
+	if err = db.Write(base, incompatible); !errors.As(err, &schemaError) {
+		t.Fatalf("an incompatible write: %v", err)
+	}
+
+	// 没有记录消息类型的文件不做检查，但无法动态解码
+	other := base.Add(snapsdb.TimestampOf1Day)
+	if err = db.Write(other, &types.ProcessInfo{Pid: 9}); err != nil {
+		t.Fatal(err)
+	}
+	db.Dispose()
+	files, _ := filepath.Glob(filepath.Join(path, "*.schema"))
+	if len(files) != 2 {
+		t.Fatalf("unexpected schema files %v", files)
+	}
+	os.Remove(files[1])
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if _, err = db.Schema(other); err != snapsdb.ErrorNoSchema {
+		t.Fatalf("unexpected schema of a file without one: %v", err)
+	}
+	if _, err = snapsdb.QueryDynamic(db, base, other.Add(time.Minute)); err != snapsdb.ErrorNoSchema {
+		t.Fatalf("dynamic query of a file without schema: %v", err)
+	}
+	if list, err := snapsdb.QueryTimeline[wrapperspb.Int64Value](db, other); err != nil || len(list) != 1 {
+		t.Fatalf("unexpected query of a file without schema %v, %v", list, err)
+	}
+}
+
+// 测试 损坏的 schema 文件不影响存储文件的读写，下一次写入重新记录
+func TestDamagedSchema(t *testing.T) {
+	path := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	if err = db.Write(base, &types.ProcessInfo{Pid: 1, Name: "nginx"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Dispose()
+	files, _ := filepath.Glob(filepath.Join(path, "*.schema"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected schema files %v", files)
+	}
+	// a schema left empty by a crash
+	if err = os.WriteFile(files[0], nil, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if list, err := snapsdb.QueryTimeline[types.ProcessInfo](db, base); err != nil || len(list) != 1 {
+		t.Fatalf("unexpected query of a file with a damaged schema %v, %v", list, err)
+	}
+	if _, err = db.Schema(base); err != snapsdb.ErrorNoSchema {
+		t.Fatalf("unexpected damaged schema: %v", err)
+	}
+	if err = db.Write(base.Add(time.Second), &types.ProcessInfo{Pid: 2, Name: "java"}); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor, err := db.Schema(base); err != nil || descriptor.FullName() != "types.ProcessInfo" {
+		t.Fatalf("the schema was not recorded again %v, %v", descriptor, err)
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 一个数据库内的多个命名序列
+func TestSeries(t *testing.T) {
+	path := t.TempDir()
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	proc, err := db.Series("proc", snapsdb.WithIndex("pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockets, err := db.Series("sockets", snapsdb.WithCompression(snapsdb.CompressionFlate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := db.Series("proc"); again != proc {
+		t.Fatal("the opened series is not reused")
+	}
+	for i := 0; i < 10; i++ {
+		timeline := base.Add(time.Second * time.Duration(i))
+		if err = proc.Write(timeline, &types.ProcessInfo{Pid: int32(i)}, &types.ProcessInfo{Pid: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err = sockets.Write(timeline, &types.ProcessInfo{Name: "tcp"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Write(base, &types.ProcessInfo{Name: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	// 查询限定在序列内
+	counts := map[snapsdb.SnapsDB]int{db: 1, proc: 20, sockets: 10}
+	for series, expected := range counts {
+		timelines, err := snapsdb.QueryBetween[types.ProcessInfo](series, base, base.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, timeline := range timelines {
+			total += len(timeline.Data)
+		}
+		if total != expected {
+			t.Fatalf("%s: %d records, expected %d", series.StorageDirectory(), total, expected)
+		}
+	}
+	page, err := snapsdb.QueryIndex[types.ProcessInfo](proc, base, base.Add(time.Minute), 100)
+	if err != nil || len(page.Timelines) != 10 {
+		t.Fatalf("index query of a series: %v", err)
+	}
+	if _, err = snapsdb.QueryIndex[types.ProcessInfo](sockets, base, base.Add(time.Minute), 100); err != snapsdb.ErrorNoIndex {
+		t.Fatalf("the index option is inherited: %v", err)
+	}
+	for _, name := range []string{"", "../x", ".hidden", "a/b"} {
+		if _, err = db.Series(name); err == nil {
+			t.Fatalf("invalid series name %q accepted", name)
+		}
+	}
+	names, err := db.ListSeries()
+	if err != nil || len(names) != 2 || names[0] != "proc" || names[1] != "sockets" {
+		t.Fatalf("unexpected series %v, %v", names, err)
+	}
+	db.Dispose()
+	if err = proc.Write(base, &types.ProcessInfo{}); err == nil {
+		t.Fatal("a series of a disposed database accepted a write")
+	}
+	// 重新打开后数据仍在
+	db, err = snapsdb.InitDB(snapsdb.WithDataPath(path), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if sockets, err = db.Series("sockets"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := snapsdb.QueryTimeline[types.ProcessInfo](sockets, base)
+	if err != nil || len(list) != 1 || list[0].Name != "tcp" {
+		t.Fatalf("unexpected series data %v, %v", list, err)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+)
+
+// 测试 数据库统计与 Prometheus 导出
+func TestStats(t *testing.T) {
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	base := time.Date(2022, 9, 22, 23, 59, 55, 0, time.Local)
+	// 跨天写入两个文件
+	for i := 0; i < 10; i++ {
+		if err = db.Write(base.Add(time.Second*time.Duration(i)), &types.ProcessInfo{Pid: 1, Name: "a"}, &types.ProcessInfo{Pid: 2, Name: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(base, &list); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Writes != 10 || stats.ObjectsWritten != 20 || stats.BytesWritten == 0 || stats.Queries != 2 || stats.QueryLatency.Count != 2 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+	if stats.OpenFiles != 2 || stats.FilesOpened != 2 || len(stats.Files) != 2 || !stats.Files[0].Open || stats.Files[0].Size == 0 {
+		t.Fatalf("unexpected files %+v", stats.Files)
+	}
+	if stats.TotalBytes != stats.Files[0].Size+stats.Files[1].Size {
+		t.Fatalf("total bytes %d", stats.TotalBytes)
+	}
+	recorder := httptest.NewRecorder()
+	snapsdb.PrometheusHandler(db).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Result().Body)
+	for _, expected := range []string{
+		"# TYPE snapsdb_writes_total counter",
+		"snapsdb_objects_written_total{path=",
+		"} 20\n",
+		"snapsdb_query_duration_seconds_bucket{",
+		`le="+Inf"} 2`,
+		"snapsdb_query_duration_seconds_count{",
+		`file="`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("metrics without %q:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+)
+
+// 测试 按标签查询数据点
+func TestTagQueries(t *testing.T) {
+	base := time.Date(2022, 9, 22, 5, 0, 0, 0, time.Local)
+	for _, indexed := range []bool{true, false} {
+		opts := []snapsdb.Option{snapsdb.WithDataPath(t.TempDir()), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+		if indexed {
+			opts = append(opts, snapsdb.WithTagIndex())
+		}
+		db, err := snapsdb.InitDB(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 6; i++ {
+			points := make([]*snapsdb.DataPoint, 0)
+			for h := 1; h <= 3; h++ {
+				role := "api"
+				if h == 3 {
+					role = "db"
+				}
+				points = append(points, &snapsdb.DataPoint{
+					Tags:   snapsdb.TagPair{"host": fmt.Sprintf("web-%02d", h), "role": role, "slot": h},
+					Values: snapsdb.ValuePair{"cpu": float64(i*10 + h)},
+				})
+			}
+			if err = db.WritePoints(base.Add(time.Second*time.Duration(i)), points...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.WritePoints(base.Add(time.Hour*24), &snapsdb.DataPoint{Tags: snapsdb.TagPair{"host": "web-04", "zone": "b"}})
+		cases := []struct {
+			opts   []snapsdb.QueryOption
+			points int
+		}{
+			{[]snapsdb.QueryOption{snapsdb.WithTag("host", "web-01"), snapsdb.WithTag("role", "api")}, 6},
+			{[]snapsdb.QueryOption{snapsdb.WithTag("host", "web-03"), snapsdb.WithTag("role", "api")}, 0},
+			{[]snapsdb.QueryOption{snapsdb.WithTagIn("host", "web-01", "web-03")}, 12},
+			{[]snapsdb.QueryOption{snapsdb.WithTagRegex("host", "web-0[23]")}, 12},
+			{[]snapsdb.QueryOption{snapsdb.WithTagRegex("host", "web")}, 0},
+			{[]snapsdb.QueryOption{snapsdb.WithTag("slot", 2)}, 6},
+			{[]snapsdb.QueryOption{snapsdb.WithTag("slot", "2"), snapsdb.WithTagRegex("role", "a.*")}, 6},
+			{[]snapsdb.QueryOption{snapsdb.WithTag("zone", "b")}, 0},
+		}
+		for i, c := range cases {
+			page, err := snapsdb.QueryPoints(db, base, base.Add(time.Minute), c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			points := 0
+			for _, timeline := range page.Timelines {
+				points += len(timeline.Data)
+			}
+			if points != c.points {
+				t.Fatalf("indexed %v case %d: %d points, expected %d", indexed, i, points, c.points)
+			}
+		}
+		page, err := snapsdb.QueryPoints(db, base, base.Add(time.Hour*48), snapsdb.WithTag("host", "web-02"), snapsdb.WithPageSize(4))
+		if err != nil || len(page.Timelines) != 4 || page.Next == "" || page.Timelines[3].Data[0].Values["cpu"] != float64(32) {
+			t.Fatalf("unexpected page %+v, %v", page, err)
+		}
+		if _, err = snapsdb.QueryPoints(db, base, base.Add(time.Minute), snapsdb.WithTagRegex("host", "(")); err == nil {
+			t.Fatal("an invalid tag expression was accepted")
+		}
+		if !indexed {
+			if _, err = db.TagKeys(base, base.Add(time.Minute)); err != snapsdb.ErrorNoIndex {
+				t.Fatalf("tag keys without a tag index: %v", err)
+			}
+			db.Dispose()
+			continue
+		}
+		keys, err := db.TagKeys(base, base.Add(time.Minute))
+		if err != nil || !reflect.DeepEqual(keys, []string{"host", "role", "slot"}) {
+			t.Fatalf("unexpected tag keys %v, %v", keys, err)
+		}
+		hosts, err := db.TagValues(base, base.Add(time.Hour*48), "host")
+		if err != nil || !reflect.DeepEqual(hosts, []string{"web-01", "web-02", "web-03", "web-04"}) {
+			t.Fatalf("unexpected tag values %v, %v", hosts, err)
+		}
+		if roles, _ := db.TagValues(base.Add(time.Hour*24), base.Add(time.Hour*48), "role"); len(roles) != 0 {
+			t.Fatalf("unexpected tag values %v", roles)
+		}
+		db.Dispose()
+	}
+}
@@ -0,0 +1,198 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+)
+
+// 测试 数据文件校验与修复
+func TestVerifyAndRepair(t *testing.T) {
+	dataPath := t.TempDir()
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		db.Write(base, &types.ProcessInfo{Pid: int32(i), Name: "docker-compose"})
+		db.Write(base.Add(time.Second), &types.ProcessInfo{Pid: int32(i + 10), Name: "docker-compose"})
+	}
+	reports, err := db.Verify()
+	if err != nil || len(reports) != 1 || !reports[0].OK() || reports[0].Records != 6 {
+		t.Fatalf("expected a healthy file with 6 records, got %v %v", reports, err)
+	}
+	db.Dispose()
+
+	// break the index entry of the first timeline and cut the payload of the last record
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(base)))
+	file, err := os.OpenFile(filename, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := base.Unix() - util.GetUnixOfDay(base)
+	entry := make([]byte, 8)
+	binary.LittleEndian.PutUint32(entry, 0xFFFFFF)
+	file.WriteAt(entry, snapsdb.FileHeaderSize+index*snapsdb.MateInfoSize64)
+	stat, _ := file.Stat()
+	file.Truncate(stat.Size() - 3)
+	file.Close()
+
+	report, err := snapsdb.VerifyFile(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[snapsdb.IssueKind]bool)
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+		kinds[issue.Kind] = true
+	}
+	if !kinds[snapsdb.IssueIndex] || !kinds[snapsdb.IssueTruncated] {
+		t.Fatalf("expected index and truncated issues, got %v", report.Issues)
+	}
+	report, err = snapsdb.VerifyFile(filename, true)
+	if err != nil || !report.Repaired {
+		t.Fatalf("expected the file to be repaired, got %v %v", report, err)
+	}
+	report, err = snapsdb.VerifyFile(filename, false)
+	if err != nil || !report.OK() || report.Records != 5 {
+		t.Fatalf("expected a healthy file with 5 records after repair, got %v %v", report, err)
+	}
+
+	db, err = snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	list := make([]types.ProcessInfo, 0)
+	db.QueryTimeline(base, &list)
+	if len(list) != 3 {
+		t.Fatalf("expected 3 records after repair, got %v", list)
+	}
+}
+
+// 测试 不修复的校验只读取文件：未完成的预写日志只报告不重放，校验打开的文件随后关闭
+func TestVerifyReadOnly(t *testing.T) {
+	dataPath := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	if err = db.Write(base, &types.ProcessInfo{Pid: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Write(base.Add(snapsdb.TimestampOf1Day), &types.ProcessInfo{Pid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	db.Dispose()
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(base)))
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an interrupted write that would grow the file
+	walFile := strings.TrimSuffix(filename, ".bin") + ".wal"
+	pending := completeWalLog(int64(len(content))+100, append(content, make([]byte, 100)...))
+	if err = os.WriteFile(walFile, pending, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	reports, err := db.Verify()
+	if err != nil || len(reports) != 2 {
+		t.Fatalf("unexpected reports %v, %v", reports, err)
+	}
+	if len(reports[0].Issues) != 1 || reports[0].Issues[0].Kind != snapsdb.IssuePendingLog || !reports[1].OK() {
+		t.Fatalf("expected a pending log issue of the first file, got %v %v", reports[0].Issues, reports[1].Issues)
+	}
+	if after, _ := os.ReadFile(filename); !bytes.Equal(after, content) {
+		t.Fatal("verify changed the storage file")
+	}
+	if after, _ := os.ReadFile(walFile); !bytes.Equal(after, pending) {
+		t.Fatal("verify changed the write ahead log")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dataPath, "*.wal")); len(matches) != 1 {
+		t.Fatalf("verify created write ahead logs %v", matches)
+	}
+	if stats, err := db.Stats(); err != nil || stats.OpenFiles != 0 {
+		t.Fatalf("%d files left open by verify", stats.OpenFiles)
+	}
+	// 打开文件时重放预写日志
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(base, &list); err != nil || len(list) != 1 {
+		t.Fatalf("unexpected query after verify %v, %v", list, err)
+	}
+	if reports, err = db.Verify(); err != nil || !reports[0].OK() || !reports[1].OK() {
+		t.Fatalf("unexpected reports after the log was replayed %v, %v", reports, err)
+	}
+}
+
+// 测试 修复时跳过损坏的记录，从下一条完整的记录继续扫描，损坏的文件尾部被截断
+func TestRepairSkipsDamagedRecords(t *testing.T) {
+	dataPath := t.TempDir()
+	options := []snapsdb.Option{snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+	db, err := snapsdb.InitDB(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	for i := 0; i < 6; i++ {
+		db.Write(base.Add(time.Duration(i)*time.Second), &types.ProcessInfo{Pid: int32(i), Name: "docker-compose"})
+	}
+	// a timeline in another chunk of the index table
+	db.Write(base.Add(2*time.Hour), &types.ProcessInfo{Pid: 6, Name: "docker-compose"})
+	db.Dispose()
+	filename := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(base)))
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first record address of a timeline
+	first := func(i int64) int64 {
+		index := base.Unix() - util.GetUnixOfDay(base) + i
+		return int64(binary.LittleEndian.Uint64(content[snapsdb.FileHeaderSize+index*snapsdb.MateInfoSize64:]))
+	}
+	// damage the data of the third record and append a torn tail
+	damaged := append([]byte{}, content...)
+	damaged[first(3)-1] ^= 0xFF
+	damaged = append(damaged, bytes.Repeat([]byte{0xAB}, 10)...)
+	if err = os.WriteFile(filename, damaged, 0777); err != nil {
+		t.Fatal(err)
+	}
+	report, err := snapsdb.VerifyFile(filename, true)
+	if err != nil || !report.Repaired {
+		t.Fatalf("expected the file to be repaired, got %v %v", report, err)
+	}
+	expected := []snapsdb.SkippedRange{{Address: first(2), Length: first(3) - first(2)}, {Address: int64(len(content)), Length: 10}}
+	if len(report.Skipped) != 2 || report.Skipped[0] != expected[0] || report.Skipped[1] != expected[1] {
+		t.Fatalf("unexpected skipped ranges %v, expected %v", report.Skipped, expected)
+	}
+	if stat, _ := os.Stat(filename); stat.Size() != int64(len(content)) {
+		t.Fatalf("the damaged tail was not cut, size %d", stat.Size())
+	}
+	report, err = snapsdb.VerifyFile(filename, false)
+	if err != nil || !report.OK() || report.Records != 6 {
+		t.Fatalf("expected a healthy file with 6 records after repair, got %v %v", report, err)
+	}
+	if db, err = snapsdb.InitDB(options...); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	processes, err := snapsdb.QueryBetween[types.ProcessInfo](db, base, base.Add(3*time.Hour))
+	if err != nil || len(processes) != 6 || processes[4].Data[0].Pid != 5 || processes[5].Data[0].Pid != 6 {
+		t.Fatalf("unexpected records after repair %v, %v", processes, err)
+	}
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vblegend/snapsdb"
+	"github.com/vblegend/snapsdb/test/types"
+	"github.com/vblegend/snapsdb/util"
+)
+
+// 测试 写入中断后（预写日志不完整）重新打开数据库
+func TestWalRecovery(t *testing.T) {
+	dataPath := t.TempDir()
+	db, err := snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+	if err = db.Write(timestamp, &types.ProcessInfo{Pid: 1}, &types.ProcessInfo{Pid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	db.Dispose()
+	walFile := filepath.Join(dataPath, "*.wal")
+	if matches, _ := filepath.Glob(walFile); len(matches) != 0 {
+		t.Fatalf("write ahead log not removed on close: %v", matches)
+	}
+	// a torn log left by a crash while logging
+	binFile := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(timestamp)))
+	torn := []byte{0x53, 0x57, 0x41, 0x4c, 1, 2, 3}
+	if err = os.WriteFile(strings.TrimSuffix(binFile, ".bin")+".wal", torn, 0777); err != nil {
+		t.Fatal(err)
+	}
+	db, err = snapsdb.InitDB(snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Dispose()
+	if err = db.Write(timestamp, &types.ProcessInfo{Pid: 3}); err != nil {
+		t.Fatal(err)
+	}
+	list := make([]types.ProcessInfo, 0)
+	if err = db.QueryTimeline(timestamp, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[2].Pid != 3 {
+		t.Fatalf("unexpected records after recovery: %v", list)
+	}
+}
+
+// a complete write ahead log that replaces the storage file content from offset 0
+func completeWalLog(size int64, content []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(0x4c415753))
+	binary.Write(buf, binary.LittleEndian, size)
+	binary.Write(buf, binary.LittleEndian, uint32(1))
+	binary.Write(buf, binary.LittleEndian, int64(0))
+	binary.Write(buf, binary.LittleEndian, uint32(len(content)))
+	buf.Write(content)
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// 测试 完整的预写日志在补丁未应用时重新打开会被重放，日志后残留的旧数据不影响重放
+func TestWalReplay(t *testing.T) {
+	for _, staleTail := range []bool{false, true} {
+		dataPath := t.TempDir()
+		options := []snapsdb.Option{snapsdb.WithDataPath(dataPath), snapsdb.WithDataRetention(snapsdb.TimestampOf100Year)}
+		db, err := snapsdb.InitDB(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := time.Date(2022, 9, 22, 13, 27, 43, 0, time.Local)
+		if err = db.Write(timestamp, &types.ProcessInfo{Pid: 1}); err != nil {
+			t.Fatal(err)
+		}
+		db.Dispose()
+		binFile := filepath.Join(dataPath, fmt.Sprintf("%d.bin", util.GetUnixOfDay(timestamp)))
+		before, err := os.ReadFile(binFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db, err = snapsdb.InitDB(options...); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Write(timestamp, &types.ProcessInfo{Pid: 2}); err != nil {
+			t.Fatal(err)
+		}
+		db.Dispose()
+		after, err := os.ReadFile(binFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the second write is logged but not applied
+		log := completeWalLog(int64(len(before)), after)
+		if staleTail {
+			// the tail of a longer log whose apply failed
+			log = append(log, bytes.Repeat([]byte{0xAB}, 64)...)
+		}
+		if err = os.WriteFile(binFile, before, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(strings.TrimSuffix(binFile, ".bin")+".wal", log, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = snapsdb.InitDB(options...); err != nil {
+			t.Fatal(err)
+		}
+		list := make([]types.ProcessInfo, 0)
+		if err = db.QueryTimeline(timestamp, &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[1].Pid != 2 {
+			t.Fatalf("stale tail %v: the logged write was not replayed: %v", staleTail, list)
+		}
+		db.Dispose()
+	}
+}
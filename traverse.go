@@ -50,8 +50,6 @@ func Traverse(object any, name string) {
 		case reflect.Struct:
 			TraverseStruct(rv, name)
 		case reflect.Slice:
-			f := reflect.TypeOf(object)
-			fmt.Errorf("%s%s", f.Elem().Kind(), "切片")
 			WriteVlaue(name, object)
 		default:
 
@@ -2,6 +2,7 @@ package snapsdb
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"time"
 
@@ -10,14 +11,52 @@ import (
 
 // 时间线元信息
 type timelineMateInfo struct {
-	TLFirst uint32 // Timeline first record address , for data query
-	TLLast  uint32 // Timeline last record address , for data write
+	TLFirst int64 // Timeline first record address , for data query
+	TLLast  int64 // Timeline last record address , for data write
+}
+
+// 数据记录头
+type recordHeader struct {
+	Address  int64  // record address
+	Timeline int64  // timeline of the record, in units of resolution
+	Next     int64  // next record address of the same timeline
+	Length   uint32 // data length
+	Checksum uint32 // crc32c of timeline, length and data, only in files with FlagChecksum
+	Size     int64  // record header size
+}
+
+func (h *recordHeader) dataAddress() int64 {
+	return h.Address + h.Size
+}
+
+// address after the end of the record
+func (h *recordHeader) endAddress() int64 {
+	return h.dataAddress() + int64(h.Length)
 }
 
 type dbOptions struct {
-	dataPath      string
-	retention     time.Duration
-	timekeyformat string
+	dataPath        string
+	retention       time.Duration
+	timekeyformat   string
+	resolution      time.Duration
+	syncWrite       bool
+	onCorrupt       func(err *CorruptRecordError)
+	compression     Compression
+	identity        string
+	keyframes       int
+	mmap            bool
+	index           string
+	tiers           []RollupTier
+	rollupTimelines int
+	codec           Codec
+}
+
+// codec id of new storage files
+func (o *dbOptions) codecID() uint32 {
+	if o.codec == nil {
+		return CodecProtobuf
+	}
+	return o.codec.ID()
 }
 
 type TagValue interface {
@@ -47,6 +86,24 @@ type StoreData protoreflect.ProtoMessage
 
 var ErrorDBFileNotHit = errors.New("one or more files were not hit(not found datastore file).")
 
+var ErrorFileClosed = errors.New("storage file has been closed")
+
+var ErrorInvalidStoreFile = errors.New("invalid storage file header")
+
+var ErrorFileTooLarge = errors.New("storage file with 32-bit addresses can not grow beyond 4 GiB, migrate it to the current format")
+
+// a record that can not be read back, returned by queries unless WithCorruptRecordHandler is set
+type CorruptRecordError struct {
+	File     string    // storage file name
+	Timeline time.Time // timeline of the record
+	Address  int64     // record address
+	Reason   string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at %d of %s (%s): %s", e.Address, e.File, e.Timeline.Format("2006-01-02 15:04:05.000"), e.Reason)
+}
+
 /* time */
 const (
 	// Timestamp length in 1 day
@@ -65,38 +122,106 @@ const (
 
 /* stroage file */
 const (
-	// 一天的时间线长度
+	// 一天的时间线长度（秒）
 	TimelineLengthOfDay = int64(86400)
-	// 文件头的偏移量
-	FileHeaderOffset = int64(16)
+	// 文件头标识 "SnapsDB2"
+	MagicCode = uint64(3621532312956661331)
+	// 旧版文件头标识 "Snaps-db"，时间精度固定为1秒
+	LegacyMagicCode = uint64(7089841687217925715)
+	// 文件头的大小
+	FileHeaderSize = int64(64)
+	// 旧版文件头的大小
+	LegacyFileHeaderSize = int64(16)
+	// 文件头的偏移量（格式版本1）
+	//
+	// Deprecated: the layout of format version 1 files, use LegacyFileHeaderSize. newer files have a FileHeaderSize header
+	FileHeaderOffset = LegacyFileHeaderSize
 	// 单条时间线元数据的大小
 	MateInfoSize = int64(8)
-	// 一天的时间线元数据总大小
-	MateTableSize = int64(691200)
+	// 一天的时间线元数据总大小（格式版本1）
+	//
+	// Deprecated: the layout of format version 1 files, the index table of newer files depends on the resolution and the address size
+	MateTableSize = TimelineLengthOfDay * MateInfoSize
+	// 文件第一条数据的偏移位置（格式版本1）
+	//
+	// Deprecated: the layout of format version 1 files, the data block of newer files follows their index table
+	FileDataOffset = uint32(MateTableSize + FileHeaderOffset)
+	// 单条时间线元数据的大小（64位地址，格式版本3）
+	MateInfoSize64 = int64(16)
 	// 下一条数据记录的指针偏移位置（相对于数据记录的开始位置）
 	NextDataOffset = int64(8)
-	// 文件第一条数据的偏移位置
-	FileDataOffset = uint32(MateTableSize + FileHeaderOffset)
 	// timeline    8 byte
 	// nextdata    4 byte
 	// datalen     4 byte
 	DataHeaderLen = 8 + 4 + 4
+	// timeline    8 byte
+	// nextdata    4 byte
+	// datalen     4 byte
+	// checksum    4 byte
+	ChecksumDataHeaderLen = DataHeaderLen + 4
+	// timeline    8 byte
+	// nextdata    8 byte
+	// datalen     4 byte
+	DataHeaderLen64 = 8 + 8 + 4
+	// timeline    8 byte
+	// nextdata    8 byte
+	// datalen     4 byte
+	// checksum    4 byte
+	ChecksumDataHeaderLen64 = DataHeaderLen64 + 4
+)
+
+/* file feature flags */
+const (
+	// every record carries a crc32c checksum
+	FlagChecksum = uint32(1 << 0)
+	// the objects of one write are stored in one compressed record, the compression is in the file header
+	FlagCompression = uint32(1 << 1)
+	// every write is one frame record holding the difference to the previous frame, see delta.go
+	FlagDelta = uint32(1 << 2)
 )
 
 type SnapsDB interface {
 	// write one or more pieces of data to the timeline.
 	Write(timeline time.Time, data ...StoreData) error
 	WriteUnix(timeline int64, data ...StoreData) error
+	// write one or more objects encoded by the codec of the database to the timeline, the objects do not have to be
+	// protobuf messages with another codec, see WithCodec and QueryObjects
+	/*
+		@example
+		db, err := snapsdb.InitDB(snapsdb.WithCodec(snapsdb.GobCodec))
+		db.WriteObjects(time.Now(), &Sample{Host: "web-1", Load: 0.5})
+	*/
+	WriteObjects(timeline time.Time, objects ...interface{}) error
+	WriteObjectsUnix(timeline int64, objects ...interface{}) error
+	// write one or more data points to the timeline without a protobuf schema, see QueryPoints
+	/*
+		@example
+		db.WritePoints(time.Now(), &snapsdb.DataPoint{Tags: snapsdb.TagPair{"host": "web-1"}, Values: snapsdb.ValuePair{"cpu": 12.5}})
+	*/
+	WritePoints(timeline time.Time, points ...*DataPoint) error
+	WritePointsUnix(timeline int64, points ...*DataPoint) error
 	// Query a certain timeline data, and return to the slice
-	// the slice type should be inherited from protoreflect.ProtoMessage
+	// the timeline covers [timeline, timeline + resolution) of the database
+	// the slice type should be inherited from protoreflect.ProtoMessage, or be any type the codec of the database decodes
 	/*
 		@example
 		timestamp := time.Date(2020, 9, 22, 13, 27, 43, 0, time.Local)
 		list := make([]types.ProcessInfo, 0)
 		db.QueryTimeline(timestamp, &list)
+		db.QueryTimeline(timestamp, &list, snapsdb.WithFieldFilter(`name startswith "java" && cpu > 80`))
 	*/
-	QueryTimeline(timeline time.Time, lp_out_slice interface{}) error
-	QueryTimelineUnix(timeline int64, lp_out_slice interface{}) error
+	QueryTimeline(timeline time.Time, lp_out_slice interface{}, opts ...QueryOption) error
+	QueryTimelineUnix(timeline int64, lp_out_slice interface{}, opts ...QueryOption) error
+	// query the latest timeline with data at or before timeline into the slice, looking back up to lookback (0 for no limit),
+	// with filters the latest timeline with matching objects is returned.
+	// returns the begin time of the timeline found or the zero time when there is none
+	/*
+		@example
+		list := make([]types.ProcessInfo, 0)
+		found, err := db.QueryAsOf(time.Now(), time.Minute, &list)
+	*/
+	QueryAsOf(timeline time.Time, lookback time.Duration, lp_out_slice interface{}, opts ...QueryOption) (time.Time, error)
+	QueryAsOfUnix(timeline int64, lookback time.Duration, lp_out_slice interface{}, opts ...QueryOption) (time.Time, error)
 	// query the data of a certain time interval and return the data to lp_out_map,
 	// typed protobuf.proto
 	// ErrorDBFileNotHit
@@ -105,6 +230,9 @@ type SnapsDB interface {
 		var out_map [uint32][]StoreData // keys is timeline.Unix()
 		var out_map [int64][]StoreData  // keys is timeline.Unix()
 		var out_map [uint64][]StoreData // keys is timeline.Unix()
+		var out_map [time.Time][]StoreData // keys is the begin time of each timeline, sub-second timelines are kept apart
+
+		timelines that share a key (resolution finer than the key) are merged into one slice
 
 		@example
 
@@ -113,14 +241,94 @@ type SnapsDB interface {
 		endTimestamp := time.Date(2020, 9, 22, 5, 2, 00, 0, time.Local)
 		map := make(map[string][]types.ProcessInfo)
 		db.QueryBetween(beginTimestamp, endTimestamp, &map)
+		db.QueryBetween(beginTimestamp, endTimestamp, &map, snapsdb.WithFilter(func(message snapsdb.StoreData) bool {
+			return message.(*types.ProcessInfo).Pid == 1234
+		}))
+	*/
+	QueryBetween(begin time.Time, end time.Time, lp_out_map interface{}, opts ...QueryOption) error
+	QueryBetweenUnix(begin int64, end int64, lp_out_map interface{}, opts ...QueryOption) error
+	// stream the data of a certain time interval in time order without collecting it,
+	// message is reused for every object, the iteration stops when fn returns false
+	/*
+		@example
+		process := &types.ProcessInfo{}
+		db.Iterate(beginTimestamp, endTimestamp, process, func(timeline time.Time, message snapsdb.StoreData) bool {
+			fmt.Println(timeline, process.Pid)
+			return true
+		})
+	*/
+	Iterate(begin time.Time, end time.Time, message StoreData, fn func(timeline time.Time, message StoreData) bool) error
+	IterateUnix(begin int64, end int64, message StoreData, fn func(timeline time.Time, message StoreData) bool) error
+	// aggregate (count/sum/min/max/avg) a numeric field of the data of a certain time interval into buckets,
+	// message is reused to decode every object, see WithGroupBy
+	/*
+		@example
+		buckets, err := db.Aggregate(beginTimestamp, endTimestamp, time.Minute, &types.ProcessInfo{}, "cpu", snapsdb.WithGroupBy("name"))
+	*/
+	Aggregate(begin time.Time, end time.Time, bucket time.Duration, message StoreData, field string, opts ...QueryOption) ([]*AggregateBucket, error)
+	AggregateUnix(begin int64, end int64, bucket time.Duration, message StoreData, field string, opts ...QueryOption) ([]*AggregateBucket, error)
+
+	// the timelines with data between begin and end, read from the index tables without decoding the data,
+	// with counts the records of every timeline are counted as well
+	/*
+		@example
+		coverage, err := db.Coverage(beginTimestamp, endTimestamp, true)
+		nearest, ok := coverage.Nearest(timestamp)
+	*/
+	Coverage(begin time.Time, end time.Time, counts bool) (*Coverage, error)
+
+	// the tag keys, or the values of one tag key, of the data points between begin and end in ascending order,
+	// read from the tag index, see WithTagIndex
+	/*
+		@example
+		keys, err := db.TagKeys(beginTimestamp, endTimestamp)
+		hosts, err := db.TagValues(beginTimestamp, endTimestamp, "host")
+	*/
+	TagKeys(begin time.Time, end time.Time) ([]string, error)
+	TagValues(begin time.Time, end time.Time, key string) ([]string, error)
+
+	// the protobuf message type recorded for the storage file of the day of timeline, ErrorNoSchema when none was recorded.
+	// writes and queries with an incompatible message type return a *SchemaError, see QueryDynamic
+	/*
+		@example
+		descriptor, err := db.Schema(timestamp)
+		fmt.Println(descriptor.FullName())
 	*/
-	QueryBetween(begin time.Time, end time.Time, lp_out_map interface{}) error
-	QueryBetweenUnix(begin int64, end int64, lp_out_map interface{}) error
+	Schema(timeline time.Time) (protoreflect.MessageDescriptor, error)
 
 	/* Delete the stored file for the current day of the timeline */
 	DeleteStorageFile(timeline time.Time) error
 	DeleteStorageFileUnix(timeline int64) error
 
+	/* Check every storage file: index table, record chains and payload bounds. the files are only read, files the database has not opened are closed afterwards */
+	Verify() ([]*VerifyReport, error)
+	/* Check every storage file and rebuild the index table of the damaged ones from the data block */
+	Repair() ([]*VerifyReport, error)
+
+	/* Compute the complete timelines of the rollup tiers now, it runs in the background every minute */
+	Rollup() error
+
+	/* Rewrite storage files of older format versions into the current format, returns the migrated files */
+	Migrate() ([]string, error)
+
+	// open the named series of the database, a series stores its own data stream in "series/<name>" of the data path,
+	// with the retention and storage options of the database unless opts override them (WithDataPath is ignored).
+	// the options of the message type (WithIndex, WithDeltaEncoding, WithRollup) are not inherited.
+	// opts are only used when the series is opened first, the retention is enforced while the series is opened,
+	// the series is disposed with the database
+	/*
+		@example
+		proc, err := db.Series("proc", snapsdb.WithIndex("pid"))
+		proc.Write(time.Now(), processes...)
+		sockets, err := db.Series("sockets")
+	*/
+	Series(name string, opts ...Option) (SnapsDB, error)
+	/* Get the names of the series stored in the data path */
+	ListSeries() ([]string, error)
+
+	/* Get the statistics of the database and its rollup tiers, see PrometheusHandler */
+	Stats() (*Stats, error)
+
 	/* Get data file storage directory */
 	StorageDirectory() string
 
@@ -133,15 +341,21 @@ type SnapsDB interface {
 
 type StoreFile interface {
 	// 写入数据
-	Write(timestamp int64, data ...StoreData) error
+	Write(timeline time.Time, data ...StoreData) error
 	// query a timeline for data and return to a list
-	QueryTimeline(timestamp int64, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type) error
+	QueryTimeline(timeline time.Time, slice_pointer *reflect.Value, origin_slice *reflect.Value, element_type *reflect.Type, filter func(message StoreData) bool) error
 	// Query the data of a certain time interval and fill it with map[][]typed
-	QueryBetween(begin int64, end int64, map_object reflect.Value, key_type *reflect.Kind, slice_type *reflect.Type, element_type *reflect.Type) error
+	QueryBetween(begin time.Time, end time.Time, map_object reflect.Value, key_type *reflect.Kind, slice_type *reflect.Type, element_type *reflect.Type, filter func(message StoreData) bool) error
+	// call fn with every object between begin and end in time order, returns false when fn stopped the iteration
+	Iterate(begin time.Time, end time.Time, message StoreData, fn func(timeline time.Time, message StoreData) bool) (bool, error)
 	// close file
 	Close()
 	// read file timeline meta information
-	ReadMateInfo(timeline int64) (*timelineMateInfo, error)
+	ReadMateInfo(timeline time.Time) (*timelineMateInfo, error)
 	/* get file  time base line*/
 	TimeBaseline() int64
+	/* check the file, rebuild the index table from the data block when repair is true and the file is damaged */
+	Verify(repair bool) (*VerifyReport, error)
+	/* get the duration of one timeline in the file */
+	Resolution() time.Duration
 }
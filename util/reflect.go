@@ -2,9 +2,17 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+var timeType = reflect.TypeOf(time.Time{})
+
+var messageType = reflect.TypeOf((*protoreflect.ProtoMessage)(nil)).Elem()
+
 func Indirect(v reflect.Value) reflect.Value {
 	for {
 		switch v.Kind() {
@@ -22,8 +30,8 @@ func ParseMapPointer(key_map interface{}) (*reflect.Value, *reflect.Type, *refle
 	// 获取slice的类型
 	// read metainfo
 	map_pointer := reflect.ValueOf(key_map)
-	if map_pointer.Kind() != reflect.Ptr {
-		return nil, nil, nil, nil, nil, errors.New("Invalid argument 'list interface{}'")
+	if map_pointer.Kind() != reflect.Ptr || map_pointer.IsNil() || map_pointer.Elem().Kind() != reflect.Map {
+		return nil, nil, nil, nil, nil, errors.New("invalid argument, expected a pointer to map[key][]T")
 	}
 	// get list typed
 	type_interface := reflect.TypeOf(key_map)
@@ -31,10 +39,17 @@ func ParseMapPointer(key_map interface{}) (*reflect.Value, *reflect.Type, *refle
 	type_map := type_interface.Elem()
 	// get element typed
 	type_slice := type_map.Elem()
+	if type_slice.Kind() != reflect.Slice {
+		return nil, nil, nil, nil, nil, fmt.Errorf("invalid argument, map value %s is not a slice", type_slice)
+	}
 	// get element typed
 	type_keys := type_map.Key()
-	if type_keys.Kind() != reflect.String && type_keys.Kind() != reflect.Int64 {
-		return nil, nil, nil, nil, nil, errors.New("map key must be of type string or int64'")
+	switch type_keys.Kind() {
+	case reflect.String, reflect.Int64, reflect.Uint64, reflect.Uint32, reflect.Int:
+	default:
+		if type_keys != timeType {
+			return nil, nil, nil, nil, nil, errors.New("map key must be of type string, int, int64, uint32, uint64 or time.Time")
+		}
 	}
 	type_element := type_slice.Elem()
 	type_key := type_keys.Kind()
@@ -46,8 +61,8 @@ func ParseMapPointer(key_map interface{}) (*reflect.Value, *reflect.Type, *refle
 func ParseSlicePointer(list interface{}, clearList bool) (*reflect.Value, *reflect.Value, *reflect.Type, error) {
 	// read metainfo
 	slice_pointer := reflect.ValueOf(list)
-	if slice_pointer.Kind() != reflect.Ptr {
-		return nil, nil, nil, errors.New("invalid argument 'list interface{}'")
+	if slice_pointer.Kind() != reflect.Ptr || slice_pointer.IsNil() || slice_pointer.Elem().Kind() != reflect.Slice {
+		return nil, nil, nil, errors.New("invalid argument, expected a pointer to []T")
 	}
 	origin_slice := slice_pointer.Elem()
 	// get list typed
@@ -61,3 +76,14 @@ func ParseSlicePointer(list interface{}, clearList bool) (*reflect.Value, *refle
 	}
 	return &slice_pointer, &origin_slice, &element_type, nil
 }
+
+// the slice element must be a protobuf message struct or a pointer to it
+func CheckMessageElement(element reflect.Type) error {
+	if element.Kind() == reflect.Ptr {
+		element = element.Elem()
+	}
+	if element.Kind() != reflect.Struct || !reflect.PtrTo(element).Implements(messageType) {
+		return fmt.Errorf("invalid argument, slice element %s is not a protobuf message", element)
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package snapsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type IssueKind int
+
+const (
+	// file header is damaged or does not match the file
+	IssueHeader IssueKind = iota + 1
+	// index table entry points outside the data block
+	IssueIndex
+	// record next pointer points outside the data block
+	IssueDangling
+	// record chain points back to an earlier record
+	IssueCycle
+	// record timestamp does not belong to the timeline of the chain
+	IssueTimelineMismatch
+	// record payload exceeds the end of the file
+	IssueTruncated
+	// index table last record address is not the end of the chain
+	IssueLastMismatch
+	// record data does not match the record checksum
+	IssueChecksum
+	// the write ahead log holds an interrupted write, it is replayed when the file is opened for writing
+	IssuePendingLog
+)
+
+func (kind IssueKind) String() string {
+	switch kind {
+	case IssueHeader:
+		return "header"
+	case IssueIndex:
+		return "index"
+	case IssueDangling:
+		return "dangling"
+	case IssueCycle:
+		return "cycle"
+	case IssueTimelineMismatch:
+		return "timeline-mismatch"
+	case IssueTruncated:
+		return "truncated"
+	case IssueLastMismatch:
+		return "last-mismatch"
+	case IssueChecksum:
+		return "checksum"
+	case IssuePendingLog:
+		return "pending-log"
+	}
+	return "unknown"
+}
+
+// a problem found in a storage file
+type VerifyIssue struct {
+	Kind     IssueKind
+	Timeline time.Time // timeline of the chain, zero for header issues
+	Address  int64     // address of the damaged record or index entry
+	Message  string
+}
+
+func (issue VerifyIssue) String() string {
+	if issue.Timeline.IsZero() {
+		return fmt.Sprintf("[%s] %s", issue.Kind, issue.Message)
+	}
+	return fmt.Sprintf("[%s] %s @%d: %s", issue.Kind, issue.Timeline.Format("2006-01-02 15:04:05.000"), issue.Address, issue.Message)
+}
+
+// a range of the data block that held no intact record, it is left out by the repair
+type SkippedRange struct {
+	Address int64
+	Length  int64
+}
+
+// verify result of a storage file
+type VerifyReport struct {
+	File     string
+	Records  int // number of records reachable from the index table
+	Issues   []VerifyIssue
+	Repaired bool           // the index table was rebuilt from the data block
+	Skipped  []SkippedRange // damaged ranges of the data block skipped by the repair
+}
+
+// the file has no issues
+func (report *VerifyReport) OK() bool {
+	return len(report.Issues) == 0
+}
+
+func (report *VerifyReport) addIssue(kind IssueKind, timeline time.Time, address int64, format string, a ...interface{}) {
+	report.Issues = append(report.Issues, VerifyIssue{Kind: kind, Timeline: timeline, Address: address, Message: fmt.Sprintf(format, a...)})
+}
+
+// Verify a single storage file, the file must not be opened by a database.
+// when repair is true and the file has issues, the index table and the record chains are rebuilt from the data block.
+// without repair the file is only read, an interrupted write in the write ahead log is reported instead of replayed
+func VerifyFile(filename string, repair bool) (*VerifyReport, error) {
+	return verifyFile(filename, &dbOptions{}, repair)
+}
+
+// verify a storage file that is not opened and close it afterwards
+func verifyFile(filename string, options *dbOptions, repair bool) (*VerifyReport, error) {
+	timebaseline, err := parseStorageFileName(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file *storeFile
+	if repair {
+		var loaded StoreFile
+		if loaded, err = loadStoreFile(filename, timebaseline, options, false); err == nil {
+			file = loaded.(*storeFile)
+		}
+	} else {
+		file, err = openStoreFileReadOnly(filename, timebaseline)
+	}
+	if err == ErrorInvalidStoreFile {
+		report := &VerifyReport{File: filename}
+		report.addIssue(IssueHeader, time.Time{}, 0, "unknown magic code or damaged header, the file can not be repaired")
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	report, err := file.Verify(repair)
+	file.Close()
+	if err == nil && !repair {
+		if stat, statErr := os.Stat(walFileName(filename)); statErr == nil && stat.Size() > 0 {
+			report.addIssue(IssuePendingLog, time.Time{}, 0, "the write ahead log holds an interrupted write of %d bytes, it is replayed when the file is opened", stat.Size())
+		}
+	}
+	if err == nil && report.Repaired {
+		// the file may have been opened without its index, which can point into dropped bytes. it is built again on the next use
+		if removeErr := os.Remove(indexFileName(filename)); removeErr != nil && !os.IsNotExist(removeErr) {
+			return report, removeErr
+		}
+	}
+	return report, err
+}
+
+// verify every storage file of the database, the files are only read
+func (db *defaultDB) Verify() ([]*VerifyReport, error) {
+	return db.verifyFiles(false)
+}
+
+// verify every storage file of the database and rebuild the damaged ones
+func (db *defaultDB) Repair() ([]*VerifyReport, error) {
+	return db.verifyFiles(true)
+}
+
+func (db *defaultDB) verifyFiles(repair bool) ([]*VerifyReport, error) {
+	baselines, err := db.storageBaselines()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*VerifyReport, 0, len(baselines))
+	for _, timebaseline := range baselines {
+		report, err := db.verifyBaseline(timebaseline, repair)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// verify the storage file of the time base line. a file the database has opened is verified as it is,
+// any other file is opened by verify and closed afterwards, loads of the file wait until it is closed
+func (db *defaultDB) verifyBaseline(timebaseline int64, repair bool) (*VerifyReport, error) {
+	db.mutex.Lock()
+	if db.opendFiles[timebaseline] == nil && db.loadingFiles[timebaseline] == nil && !db.isDisposed {
+		// a slot without file and error, the waiting loads try again when it is released
+		loading := &fileLoading{done: make(chan struct{})}
+		db.loadingFiles[timebaseline] = loading
+		db.mutex.Unlock()
+		defer func() {
+			db.mutex.Lock()
+			delete(db.loadingFiles, timebaseline)
+			db.mutex.Unlock()
+			close(loading.done)
+		}()
+		return verifyFile(db.storageFileName(timebaseline), db.options, repair)
+	}
+	db.mutex.Unlock()
+	storeFile, err := db.loadFile(timebaseline, false)
+	if err == ErrorInvalidStoreFile {
+		report := &VerifyReport{File: db.storageFileName(timebaseline)}
+		report.addIssue(IssueHeader, time.Time{}, 0, "unknown magic code or damaged header, the file can not be repaired")
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storeFile.Verify(repair)
+}
+
+// time base lines of the storage files in the data directory, in ascending order
+func (db *defaultDB) storageBaselines() ([]int64, error) {
+	entries, err := os.ReadDir(db.basePath)
+	if err != nil {
+		return nil, err
+	}
+	baselines := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".bin") {
+			continue
+		}
+		timebaseline, err := parseStorageFileName(name)
+		if err == nil {
+			baselines = append(baselines, timebaseline)
+		}
+	}
+	sort.Slice(baselines, func(i, j int) bool { return baselines[i] < baselines[j] })
+	return baselines, nil
+}
+
+func (sf *storeFile) Verify(repair bool) (*VerifyReport, error) {
+	sf.Lock()
+	defer sf.Unlock()
+	if sf.file == nil {
+		return nil, ErrorFileClosed
+	}
+	report, err := sf.verify()
+	if err != nil || report.OK() || !repair {
+		return report, err
+	}
+	for _, issue := range report.Issues {
+		if issue.Kind == IssueHeader {
+			// the timelines of the records can not be trusted without a valid header
+			return report, nil
+		}
+	}
+	if err = sf.rebuildIndex(report); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// walk the index table and every record chain
+func (sf *storeFile) verify() (*VerifyReport, error) {
+	report := &VerifyReport{File: sf.file.Name()}
+	header := make([]byte, 16)
+	if _, err := sf.readAt(header, 0); err != nil {
+		return nil, err
+	}
+	if baseline := int64(binary.LittleEndian.Uint64(header[8:])); baseline != sf.TimelineBegin {
+		report.addIssue(IssueHeader, time.Time{}, 8, "header time base line %d does not match the file time base line %d", baseline, sf.TimelineBegin)
+		return report, nil
+	}
+	if sf.size < sf.dataOffset() {
+		report.addIssue(IssueHeader, time.Time{}, sf.size, "file size %d is smaller than the index table", sf.size)
+		return report, nil
+	}
+	var walkErr error
+	err := sf.walkIndexTable(0, sf.timelines-1, false, func(index int64, meta *timelineMateInfo) bool {
+		walkErr = sf.verifyChain(report, index, meta)
+		return walkErr == nil
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// walk the record chain of the timeline at index
+func (sf *storeFile) verifyChain(report *VerifyReport, index int64, meta *timelineMateInfo) error {
+	if meta.TLFirst == 0 && meta.TLLast == 0 {
+		return nil
+	}
+	entry := sf.headerSize + index*sf.mateInfoSize
+	timeline := sf.timelineOf(index)
+	if !sf.validAddress(meta.TLFirst) || !sf.validAddress(meta.TLLast) {
+		report.addIssue(IssueIndex, timeline, entry, "index entry first %d last %d is outside the data block", meta.TLFirst, meta.TLLast)
+		return nil
+	}
+	tick := sf.tickOf(index)
+	address := meta.TLFirst
+	for {
+		record, err := sf.readRecordHeader(address)
+		if err == io.EOF {
+			report.addIssue(IssueTruncated, timeline, address, "record header exceeds the end of the file")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Timeline != tick {
+			report.addIssue(IssueTimelineMismatch, timeline, address, "record timestamp %d does not match timeline %d", record.Timeline, tick)
+			return nil
+		}
+		if record.endAddress() > sf.size {
+			report.addIssue(IssueTruncated, timeline, address, "record payload of %d bytes exceeds the end of the file", record.Length)
+			return nil
+		}
+		if _, err := sf.readRecordData(record); err != nil {
+			if _, ok := err.(*CorruptRecordError); !ok {
+				return err
+			}
+			report.addIssue(IssueChecksum, timeline, address, "record data of %d bytes does not match the checksum", record.Length)
+		}
+		report.Records++
+		if record.Next == 0 {
+			if address != meta.TLLast {
+				report.addIssue(IssueLastMismatch, timeline, entry, "chain ends at %d but the index entry last is %d", address, meta.TLLast)
+			}
+			return nil
+		}
+		// records are appended, a chain always points forward
+		if record.Next <= address {
+			report.addIssue(IssueCycle, timeline, address, "next record %d points backward", record.Next)
+			return nil
+		}
+		if !sf.validAddress(record.Next) {
+			report.addIssue(IssueDangling, timeline, address, "next record %d is outside the data block", record.Next)
+			return nil
+		}
+		address = record.Next
+	}
+}
+
+// the address is inside the data block
+func (sf *storeFile) validAddress(address int64) bool {
+	return address >= sf.dataOffset() && address+sf.recordSize <= sf.size
+}
+
+// scan the data block from the beginning and link every intact record to the chain of its timeline.
+// the scan resumes at the next intact record after damaged bytes, the skipped ranges are added to the report.
+// the index table and the chain links are written in chunks, the cut of a damaged tail is committed with the last chunk
+func (sf *storeFile) rebuildIndex(report *VerifyReport) error {
+	chains := make(map[int64][]int64)
+	address := sf.dataOffset()
+	end := address
+	for address < sf.size {
+		record, err := sf.intactRecord(address)
+		if err == nil && record == nil {
+			if record, err = sf.resyncRecord(address + 1); err == nil {
+				next := sf.size
+				if record != nil {
+					next = record.Address
+				}
+				report.Skipped = append(report.Skipped, SkippedRange{Address: address, Length: next - address})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			break
+		}
+		index := record.Timeline - sf.tickOf(0)
+		chains[index] = append(chains[index], record.Address)
+		address = record.endAddress()
+		end = address
+	}
+	if sf.index != nil {
+		// the index may point into the dropped tail
+		if err := sf.index.clear(); err != nil {
+			return err
+		}
+	}
+	indexes := make([]int64, 0, len(chains))
+	for index := range chains {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	// truncating a mapped file faults on access to the dropped pages
+	sf.unmap()
+	// the table is written in chunks of indexTableChunk timelines with the links of their chains, the chunks only
+	// point below end and the last one is committed together with the cut of the file
+	for first := int64(0); first < sf.timelines; first += indexTableChunk {
+		last := first + indexTableChunk - 1
+		if last >= sf.timelines {
+			last = sf.timelines - 1
+		}
+		table := make([]byte, (last-first+1)*sf.mateInfoSize)
+		patches := make([]walPatch, 0)
+		for len(indexes) > 0 && indexes[0] <= last {
+			index := indexes[0]
+			indexes = indexes[1:]
+			chain := chains[index]
+			for i, address := range chain {
+				next := make([]byte, sf.addressSize)
+				if i < len(chain)-1 {
+					sf.putAddress(next, chain[i+1])
+				}
+				patches = append(patches, walPatch{offset: address + NextDataOffset, data: next})
+			}
+			sf.encodeMateInfo(table[(index-first)*sf.mateInfoSize:], &timelineMateInfo{TLFirst: chain[0], TLLast: chain[len(chain)-1]})
+		}
+		size := sf.size
+		if last == sf.timelines-1 {
+			size = end
+		} else if len(patches) == 0 {
+			// a chunk that is already in place is not written
+			current := make([]byte, len(table))
+			if _, err := sf.readAt(current, sf.headerSize+first*sf.mateInfoSize); err != nil && err != io.EOF {
+				return err
+			}
+			if bytes.Equal(current, table) {
+				continue
+			}
+		}
+		patches = append(patches, walPatch{offset: sf.headerSize + first*sf.mateInfoSize, data: table})
+		if err := sf.wal.commit(sf.file, size, patches); err != nil {
+			sf.resync()
+			return err
+		}
+	}
+	sf.size = end
+	if sf.mmap {
+		sf.remap()
+	}
+	// frames may have been dropped, the next write starts with a keyframe
+	sf.lastFrame = nil
+	sf.cacheFrame(nil)
+	return nil
+}
+
+// the header of the intact record at address, nil when the bytes at address are not a record of this file
+func (sf *storeFile) intactRecord(address int64) (*recordHeader, error) {
+	record, err := sf.readRecordHeader(address)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := record.Timeline - sf.tickOf(0)
+	if index < 0 || index >= sf.timelines || record.endAddress() > sf.size {
+		return nil, nil
+	}
+	if sf.flags&FlagChecksum != 0 {
+		// the length of a record with a bad checksum can not be trusted either
+		if _, err = sf.readRecordData(record); err != nil {
+			if _, ok := err.(*CorruptRecordError); ok {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// find the next intact record from address on, nil when there is none until the end of the file.
+// the bytes are read in windows and only offsets holding a timestamp of this file are checked
+func (sf *storeFile) resyncRecord(address int64) (*recordHeader, error) {
+	window := make([]byte, 64*1024)
+	first := sf.tickOf(0)
+	for address+sf.recordSize <= sf.size {
+		size := sf.size - address
+		if size > int64(len(window)) {
+			size = int64(len(window))
+		}
+		n, err := sf.readAt(window[:size], address)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n < 8 {
+			break
+		}
+		for i := 0; i+8 <= n; i++ {
+			tick := int64(binary.LittleEndian.Uint64(window[i:]))
+			if tick < first || tick >= first+sf.timelines {
+				continue
+			}
+			record, err := sf.intactRecord(address + int64(i))
+			if err != nil || record != nil {
+				return record, err
+			}
+		}
+		// the timestamps starting in the last 7 bytes are read again with the next window
+		address += int64(n - 7)
+	}
+	return nil, nil
+}
@@ -0,0 +1,177 @@
+package snapsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// write ahead log format
+// =============================
+// a storage file write is a set of patches (offset + data) to the storage file,
+// the patches are logged before they are applied, and the log is emptied after
+// all patches are applied. a non-empty log found on load means the write was
+// interrupted and must be replayed.
+//
+// magic code       size 4 byte
+// file size        size 8 byte    storage file size before the write
+// patch count      size 4 byte
+// patches          offset 8 byte | length 4 byte | data
+// crc32            size 4 byte    checksum of all bytes before it
+//
+// the log is emptied before it is written, bytes after the crc32 are ignored.
+// =============================
+
+// write ahead log magic code "SWAL"
+const walMagicCode = uint32(0x4c415753)
+
+var errorWalTorn = errors.New("write ahead log is incomplete")
+
+// a write to the storage file
+type walPatch struct {
+	offset int64
+	data   []byte
+}
+
+type writeAheadLog struct {
+	file *os.File // write ahead log access object
+	sync bool     // fsync the log and the storage file on every commit
+}
+
+// open the write ahead log of a storage file, the log file is created when it does not exist
+func openWriteAheadLog(filename string, sync bool) (*writeAheadLog, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file, sync: sync}, nil
+}
+
+// log the patches, apply them to the target file and empty the log
+// size is the size of the target file before the patches are applied, a longer file is cut to it as on replay
+func (wal *writeAheadLog) commit(target *os.File, size int64, patches []walPatch) error {
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	binary.Write(buf, binary.LittleEndian, walMagicCode)
+	binary.Write(buf, binary.LittleEndian, size)
+	binary.Write(buf, binary.LittleEndian, uint32(len(patches)))
+	for _, patch := range patches {
+		binary.Write(buf, binary.LittleEndian, patch.offset)
+		binary.Write(buf, binary.LittleEndian, uint32(len(patch.data)))
+		buf.Write(patch.data)
+	}
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	// a log left by a failed apply is replaced, its tail must not follow the new log
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wal.file.WriteAt(buf.Bytes(), 0); err != nil {
+		return err
+	}
+	if err := wal.flush(wal.file); err != nil {
+		return err
+	}
+	if err := target.Truncate(size); err != nil {
+		return err
+	}
+	if err := applyPatches(target, patches); err != nil {
+		return err
+	}
+	if err := wal.flush(target); err != nil {
+		return err
+	}
+	return wal.file.Truncate(0)
+}
+
+// replay an interrupted write on the target file.
+// a complete log is applied again, an incomplete log means the target file was not touched yet and is discarded.
+func (wal *writeAheadLog) recover(target *os.File) error {
+	size, patches, err := wal.read()
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		// drop anything appended after the logged size, the patches rewrite it
+		if err = target.Truncate(size); err != nil {
+			return err
+		}
+		if err = applyPatches(target, patches); err != nil {
+			return err
+		}
+		if err = target.Sync(); err != nil {
+			return err
+		}
+	} else if err != errorWalTorn {
+		return err
+	}
+	return wal.file.Truncate(0)
+}
+
+// read the logged write, io.EOF is returned when the log is empty
+func (wal *writeAheadLog) read() (int64, []walPatch, error) {
+	stat, err := wal.file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if stat.Size() == 0 {
+		return 0, nil, io.EOF
+	}
+	buffer := make([]byte, stat.Size())
+	if _, err = wal.file.ReadAt(buffer, 0); err != nil {
+		return 0, nil, err
+	}
+	if len(buffer) < 20 || binary.LittleEndian.Uint32(buffer[:4]) != walMagicCode {
+		return 0, nil, errorWalTorn
+	}
+	size := int64(binary.LittleEndian.Uint64(buffer[4:12]))
+	count := binary.LittleEndian.Uint32(buffer[12:16])
+	patches := make([]walPatch, 0)
+	body := buffer[16:]
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 12 {
+			return 0, nil, errorWalTorn
+		}
+		offset := int64(binary.LittleEndian.Uint64(body[:8]))
+		length := binary.LittleEndian.Uint32(body[8:12])
+		body = body[12:]
+		if uint32(len(body)) < length {
+			return 0, nil, errorWalTorn
+		}
+		patches = append(patches, walPatch{offset: offset, data: body[:length]})
+		body = body[length:]
+	}
+	// the checksum follows the patches, anything after it is not part of the log
+	end := len(buffer) - len(body)
+	if len(body) < 4 || crc32.ChecksumIEEE(buffer[:end]) != binary.LittleEndian.Uint32(body[:4]) {
+		return 0, nil, errorWalTorn
+	}
+	return size, patches, nil
+}
+
+func (wal *writeAheadLog) flush(file *os.File) error {
+	if wal.sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// close and remove the log, it is always empty after a successful commit
+func (wal *writeAheadLog) close() error {
+	stat, err := wal.file.Stat()
+	wal.file.Close()
+	if err == nil && stat.Size() == 0 {
+		return os.Remove(wal.file.Name())
+	}
+	return err
+}
+
+func applyPatches(target *os.File, patches []walPatch) error {
+	for _, patch := range patches {
+		if _, err := target.WriteAt(patch.data, patch.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}